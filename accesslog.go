@@ -0,0 +1,179 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+AccessLogEntry describes a single API call that was handled by the scaffold.
+It is passed to an AccessLogFormatter once the call is complete.
+*/
+type AccessLogEntry struct {
+	Time       time.Time
+	Method     string
+	Path       string
+	Protocol   string
+	Status     int
+	Bytes      int64
+	Duration   time.Duration
+	RemoteAddr string
+	RequestID  string
+	// User is the subject of the JWT that was verified by an OAuthService,
+	// if any.
+	User      string
+	Referer   string
+	UserAgent string
+}
+
+/*
+AccessLogFormatter is a type of function that turns an access log entry into
+a single line of output, without the trailing newline.
+*/
+type AccessLogFormatter func(e *AccessLogEntry) string
+
+/*
+accessLog writes entries to a writer, one line at a time.
+*/
+type accessLog struct {
+	lock   sync.Mutex
+	out    io.Writer
+	format AccessLogFormatter
+}
+
+/*
+SetAccessLog turns on logging of every API call that passes through the
+scaffold. Each call is formatted using "format," for instance
+CommonLogFormat, CombinedLogFormat or JSONLogFormat, and written to "out"
+as a single line. Calls to the management paths, such as the health check,
+are not logged. It must be called before "Listen."
+*/
+func (s *HTTPScaffold) SetAccessLog(out io.Writer, format AccessLogFormatter) {
+	s.accessLog = &accessLog{
+		out:    out,
+		format: format,
+	}
+}
+
+func (l *accessLog) write(e *AccessLogEntry) {
+	line := l.format(e) + "\n"
+	l.lock.Lock()
+	io.WriteString(l.out, line)
+	l.lock.Unlock()
+}
+
+/*
+newAccessLogEntry creates an entry for the request and adds it to the
+request context so that the user name may be filled in later.
+*/
+func newAccessLogEntry(req *http.Request, start time.Time) (*AccessLogEntry, *http.Request) {
+	e := &AccessLogEntry{
+		Time:       start,
+		Method:     req.Method,
+		Path:       req.RequestURI,
+		Protocol:   req.Proto,
+		RemoteAddr: req.RemoteAddr,
+		RequestID:  FetchRequestID(req),
+		Referer:    req.Referer(),
+		UserAgent:  req.UserAgent(),
+	}
+	if e.Path == "" {
+		e.Path = req.URL.RequestURI()
+	}
+	ctx := context.WithValue(req.Context(), accessLogKey, e)
+	return e, req.WithContext(ctx)
+}
+
+/*
+setAccessLogUser records the authenticated user in the access log entry
+for the request, if there is one.
+*/
+func setAccessLogUser(req *http.Request, user string) {
+	if e, ok := req.Context().Value(accessLogKey).(*AccessLogEntry); ok {
+		e.User = user
+	}
+}
+
+/*
+CommonLogFormat formats an entry in the NCSA Common Log Format.
+*/
+func CommonLogFormat(e *AccessLogEntry) string {
+	host, _, err := net.SplitHostPort(e.RemoteAddr)
+	if err != nil {
+		host = e.RemoteAddr
+	}
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = fmt.Sprint(e.Bytes)
+	}
+	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s",
+		logField(host), logField(e.User),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, e.Path, e.Protocol, e.Status, bytes)
+}
+
+/*
+CombinedLogFormat formats an entry in the Combined Log Format, which is the
+Common Log Format plus the referer and user agent.
+*/
+func CombinedLogFormat(e *AccessLogEntry) string {
+	return fmt.Sprintf("%s %q %q",
+		CommonLogFormat(e), logField(e.Referer), logField(e.UserAgent))
+}
+
+/*
+JSONLogFormat formats an entry as a single JSON object.
+*/
+func JSONLogFormat(e *AccessLogEntry) string {
+	je := map[string]interface{}{
+		"time":       e.Time.Format(time.RFC3339Nano),
+		"method":     e.Method,
+		"path":       e.Path,
+		"protocol":   e.Protocol,
+		"status":     e.Status,
+		"bytes":      e.Bytes,
+		"durationMs": float64(e.Duration) / float64(time.Millisecond),
+		"remoteAddr": e.RemoteAddr,
+	}
+	if e.RequestID != "" {
+		je["requestId"] = e.RequestID
+	}
+	if e.User != "" {
+		je["user"] = e.User
+	}
+	if e.Referer != "" {
+		je["referer"] = e.Referer
+	}
+	if e.UserAgent != "" {
+		je["userAgent"] = e.UserAgent
+	}
+	buf, _ := json.Marshal(je)
+	return string(buf)
+}
+
+func logField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
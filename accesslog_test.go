@@ -0,0 +1,73 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"encoding/json"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Access log tests", func() {
+	entry := &AccessLogEntry{
+		Time:       time.Date(2000, time.October, 10, 13, 55, 36, 0, time.FixedZone("PDT", -7*60*60)),
+		Method:     "GET",
+		Path:       "/apache_pb.gif",
+		Protocol:   "HTTP/1.0",
+		Status:     200,
+		Bytes:      2326,
+		Duration:   1500 * time.Microsecond,
+		RemoteAddr: "127.0.0.1:1234",
+		User:       "frank",
+		Referer:    "http://www.example.com/start.html",
+		UserAgent:  "Mozilla/4.08",
+	}
+
+	It("Common log format", func() {
+		Expect(CommonLogFormat(entry)).Should(Equal(
+			`127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326`))
+		Expect(CommonLogFormat(&AccessLogEntry{
+			Time:       entry.Time,
+			Method:     "GET",
+			Path:       "/",
+			Protocol:   "HTTP/1.1",
+			Status:     204,
+			RemoteAddr: "10.0.0.1:80",
+		})).Should(Equal(
+			`10.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET / HTTP/1.1" 204 -`))
+	})
+
+	It("Combined log format", func() {
+		Expect(CombinedLogFormat(entry)).Should(Equal(
+			`127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 ` +
+				`"http://www.example.com/start.html" "Mozilla/4.08"`))
+	})
+
+	It("JSON log format", func() {
+		var vals map[string]interface{}
+		err := json.Unmarshal([]byte(JSONLogFormat(entry)), &vals)
+		Expect(err).Should(Succeed())
+		Expect(vals["method"]).Should(Equal("GET"))
+		Expect(vals["path"]).Should(Equal("/apache_pb.gif"))
+		Expect(vals["status"]).Should(BeEquivalentTo(200))
+		Expect(vals["bytes"]).Should(BeEquivalentTo(2326))
+		Expect(vals["durationMs"]).Should(BeEquivalentTo(1.5))
+		Expect(vals["remoteAddr"]).Should(Equal("127.0.0.1:1234"))
+		Expect(vals["user"]).Should(Equal("frank"))
+		Expect(vals["userAgent"]).Should(Equal("Mozilla/4.08"))
+	})
+})
@@ -0,0 +1,121 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	stdcrypto "crypto"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+
+	"github.com/SermoDigital/jose/crypto"
+	"github.com/SermoDigital/jose/jws"
+)
+
+/*
+oauthAlgorithms are the signature algorithms that VerifyOAuth supports.
+They are all allowed unless the "Algorithms" option is set.
+*/
+var oauthAlgorithms = []string{
+	"RS256", "RS384", "RS512",
+	"PS256", "PS384", "PS512",
+	"ES256", "ES384", "ES512",
+	"EdDSA",
+}
+
+/*
+signingMethodEdDSA signs and verifies tokens using Ed25519, which the
+JOSE library does not support itself.
+*/
+var signingMethodEdDSA = &eddsaSigningMethod{}
+
+func init() {
+	jws.RegisterSigningMethod(signingMethodEdDSA)
+}
+
+type eddsaSigningMethod struct{}
+
+func (m *eddsaSigningMethod) Alg() string {
+	return "EdDSA"
+}
+
+/*
+Hasher returns zero because Ed25519 signs the whole message.
+*/
+func (m *eddsaSigningMethod) Hasher() stdcrypto.Hash {
+	return 0
+}
+
+func (m *eddsaSigningMethod) Verify(raw []byte, sig crypto.Signature, key interface{}) error {
+	pk, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return crypto.ErrInvalidKey
+	}
+	if !ed25519.Verify(pk, raw, sig) {
+		return crypto.ErrSignatureInvalid
+	}
+	return nil
+}
+
+func (m *eddsaSigningMethod) Sign(data []byte, key interface{}) (crypto.Signature, error) {
+	pk, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, crypto.ErrInvalidKey
+	}
+	return ed25519.Sign(pk, data), nil
+}
+
+/*
+allowedAlgorithms returns the set of algorithms from the "Algorithms"
+option, or nil if it is not set, which allows all of them. An error is
+returned if an algorithm is not supported, or if the list is empty, since
+then no token could be verified.
+*/
+func allowedAlgorithms(algs []string) (map[string]bool, error) {
+	if algs == nil {
+		return nil, nil
+	}
+	if len(algs) == 0 {
+		return nil, errors.New("No signature algorithms are allowed")
+	}
+	allowed := make(map[string]bool)
+	for _, alg := range algs {
+		if !supportedAlgorithm(alg) {
+			return nil, fmt.Errorf("Unsupported signature algorithm %q", alg)
+		}
+		allowed[alg] = true
+	}
+	return allowed, nil
+}
+
+/*
+algorithmAllowed returns true if a token with the "alg" header may be
+verified.
+*/
+func (a *oauth) algorithmAllowed(alg string) bool {
+	if a.algorithms == nil {
+		return supportedAlgorithm(alg)
+	}
+	return a.algorithms[alg]
+}
+
+func supportedAlgorithm(alg string) bool {
+	for _, a := range oauthAlgorithms {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
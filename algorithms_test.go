@@ -0,0 +1,147 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/SermoDigital/jose/crypto"
+	"github.com/julienschmidt/httprouter"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Signature algorithm tests", func() {
+	var es256Key, es384Key *ecdsa.PrivateKey
+	var edKey ed25519.PrivateKey
+	var router *httprouter.Router
+	var oa OAuthService
+	var svr *httptest.Server
+
+	BeforeEach(func() {
+		var err error
+		es256Key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).Should(Succeed())
+		es384Key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		Expect(err).Should(Succeed())
+		_, edKey, err = ed25519.GenerateKey(rand.Reader)
+		Expect(err).Should(Succeed())
+		certBytes, err := ioutil.ReadFile("./testkeys/jwtcert.pem")
+		Expect(err).Should(Succeed())
+		rsaKey, err := crypto.ParseRSAPublicKeyFromPEM(certBytes)
+		Expect(err).Should(Succeed())
+
+		doc := `{"keys":[` +
+			jwkJSON("es256", "ES256", "sig", &es256Key.PublicKey) + `,` +
+			jwkJSON("es384", "", "sig", &es384Key.PublicKey) + `,` +
+			jwkJSON("ed", "EdDSA", "sig", edKey.Public()) + `,` +
+			jwkJSON("ps256", "PS256", "sig", rsaKey) + `]}`
+		svr = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(doc))
+		}))
+
+		oa = CreateHTTPScaffold().CreateOAuth(svr.URL)
+		router = httprouter.New()
+		router.GET(oa.SSOHandler("/foobar/:param1/:param2", buslogicHandler))
+	})
+
+	AfterEach(func() {
+		svr.Close()
+	})
+
+	It("Supported algorithms", func() {
+		code, _ := jwksGet(router, signTestJWT(crypto.SigningMethodES256, es256Key, "es256"))
+		Expect(code).Should(Equal(200))
+		code, _ = jwksGet(router, signTestJWT(crypto.SigningMethodES384, es384Key, "es384"))
+		Expect(code).Should(Equal(200))
+		code, _ = jwksGet(router, signTestJWT(signingMethodEdDSA, edKey, "ed"))
+		Expect(code).Should(Equal(200))
+
+		rsaKey := testSigningKey()
+		code, _ = jwksGet(router, signTestJWT(crypto.SigningMethodPS256, rsaKey, "ps256"))
+		Expect(code).Should(Equal(200))
+
+		// The key only allows PS256
+		code, resp := jwksGet(router, signTestJWT(crypto.SigningMethodRS256, rsaKey, "ps256"))
+		Expect(code).Should(Equal(400))
+		Expect(resp.Message).Should(Equal(
+			`Key is for algorithm "PS256", not "RS256". Validation failed.`))
+
+		// Signed by a different key of the right type
+		other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).Should(Succeed())
+		code, _ = jwksGet(router, signTestJWT(crypto.SigningMethodES256, other, "es256"))
+		Expect(code).Should(Equal(400))
+	})
+
+	It("Rejected algorithms", func() {
+		code, resp := jwksGet(router, signTestJWT(crypto.SigningMethodHS256, []byte("secret"), "es256"))
+		Expect(code).Should(Equal(400))
+		Expect(resp.Message).Should(Equal(
+			`Signature algorithm "HS256" is not allowed. Validation failed.`))
+
+		unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"es256"}`)) +
+			"." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"nobody"}`)) + "."
+		code, resp = jwksGet(router, []byte(unsigned))
+		Expect(code).Should(Equal(400))
+		Expect(resp.Message).Should(Equal(
+			`Signature algorithm "none" is not allowed. Validation failed.`))
+
+		scaf := CreateHTTPScaffold()
+		for _, algs := range [][]string{{"none"}, {"HS256"}, {}} {
+			_, err := scaf.CreateOAuthWithOptions(svr.URL, OAuthOptions{Algorithms: algs})
+			Expect(err).ShouldNot(Succeed())
+		}
+		oa, err := scaf.CreateOAuthWithOptions(svr.URL, OAuthOptions{Algorithms: []string{"ES256", "ES384"}})
+		Expect(err).Should(Succeed())
+		router = httprouter.New()
+		router.GET(oa.SSOHandler("/foobar/:param1/:param2", buslogicHandler))
+
+		code, _ = jwksGet(router, signTestJWT(crypto.SigningMethodES256, es256Key, "es256"))
+		Expect(code).Should(Equal(200))
+		code, resp = jwksGet(router, signTestJWT(signingMethodEdDSA, edKey, "ed"))
+		Expect(code).Should(Equal(400))
+		Expect(resp.Message).Should(Equal(
+			`Signature algorithm "EdDSA" is not allowed. Validation failed.`))
+	})
+
+	It("Parse PEM public keys", func() {
+		for _, key := range []interface{}{&es256Key.PublicKey, edKey.Public()} {
+			der, err := x509.MarshalPKIXPublicKey(key)
+			Expect(err).Should(Succeed())
+			pk, err := parsePublicKeyPEM(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+			Expect(err).Should(Succeed())
+			Expect(pk).Should(Equal(key))
+		}
+
+		certBytes, err := ioutil.ReadFile("./testkeys/jwtcert.pem")
+		Expect(err).Should(Succeed())
+		_, err = parsePublicKeyPEM(certBytes)
+		Expect(err).Should(Succeed())
+
+		_, err = parsePublicKeyPEM([]byte("not a key"))
+		Expect(err).ShouldNot(Succeed())
+	})
+})
@@ -0,0 +1,495 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+certificateSource is a pair of files that a certificate is loaded from.
+*/
+type certificateSource struct {
+	certFile string
+	keyFile  string
+	getPass  PasswordFunc
+}
+
+/*
+loadedCertificate is a certificate that is being served.
+*/
+type loadedCertificate struct {
+	certificateSource
+	cert    *tls.Certificate
+	expires time.Time
+}
+
+/*
+certificateInfo describes a certificate for the "certificatesPath" and the
+health report. "Expires" is the earliest time when any certificate in the
+chain expires.
+*/
+type certificateInfo struct {
+	CertFile  string    `json:"certFile"`
+	Subject   string    `json:"subject"`
+	DNSNames  []string  `json:"dnsNames,omitempty"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	Expires   time.Time `json:"expires"`
+	Default   bool      `json:"default,omitempty"`
+}
+
+/*
+certificateLoader holds the server certificates, picks one for each
+connection, and reloads them from their files when asked to.
+*/
+type certificateLoader struct {
+	sources  []certificateSource
+	dir      string
+	lock     sync.RWMutex
+	certs    []*loadedCertificate
+	names    map[string]*tls.Certificate
+	modTimes map[string]time.Time
+	lastErr  error
+	warned   map[string]bool
+}
+
+/*
+AddCertificate adds another certificate to the secure port. When a client
+asks for a server name using SNI, the secure port presents the certificate
+that matches that name. Otherwise it presents the certificate from
+"SetCertFile," or the first one that was added if that is not set.
+"getPass" may be nil if the key file is not encrypted.
+It must be called before "Open."
+*/
+func (s *HTTPScaffold) AddCertificate(certFile, keyFile string, getPass PasswordFunc) {
+	s.certificates = append(s.certificates, certificateSource{
+		certFile: certFile,
+		keyFile:  keyFile,
+		getPass:  getPass,
+	})
+}
+
+/*
+SetCertDirectory adds all the certificates in a directory to the secure
+port in the same way as "AddCertificate." Every file that ends in ".crt" and
+has a key file with the same name ending in ".key" is loaded, in order
+of their names. Other files are ignored. The directory is read again when
+the certificates are reloaded. It must be called before "Open."
+*/
+func (s *HTTPScaffold) SetCertDirectory(dir string) {
+	s.certDirectory = dir
+}
+
+/*
+SetCertificatesPath sets up a path on the management port (if set) or
+otherwise the main port that returns a JSON list of the certificates that
+the secure port is using, including the time when each one expires.
+*/
+func (s *HTTPScaffold) SetCertificatesPath(p string) {
+	s.certificatesPath = p
+}
+
+/*
+SetCertExpiryWindow adds a "tls-certificate-expiry" health check that
+reports "NotReady" when any certificate on the secure port, or any other
+certificate in its chain, will expire within "window." If "critical" is
+true, then the readiness check fails as well. Otherwise, a warning is
+logged to the "ErrorLog" from "SetServerOptions," or the standard logger.
+There is no such check unless a window is set, but the expiry time of
+each certificate is always included in the JSON health report and the
+metrics. It must be called before "Open."
+*/
+func (s *HTTPScaffold) SetCertExpiryWindow(window time.Duration, critical bool) {
+	s.certExpiryWindow = window
+	s.certExpiryCritical = critical
+}
+
+/*
+SetCertReloadInterval causes the scaffold to check the certificate and key
+files for changes on the specified interval, and to start using the new
+certificates if they change. New certificates are only used if they can be
+loaded and match their keys, and otherwise the old ones are kept and the
+failure is reported by the "tls-certificate" health check until a reload
+succeeds. That check is not critical, so it is shown in the health report
+and the metrics, but the server stays ready while it serves the old
+certificates. The default of zero means that
+the files are only reloaded when "ReloadCertificates" is called, or when
+the signal from "SetCertReloadSignal" is caught.
+It must be called before "Listen."
+*/
+func (s *HTTPScaffold) SetCertReloadInterval(d time.Duration) {
+	s.certReloadInterval = d
+}
+
+/*
+SetCertReloadSignal causes "CatchSignals" to call "ReloadCertificates"
+when the signal is caught, such as syscall.SIGUSR1. Reload failures are
+written to the same place as the stack trace. It must be called before
+"CatchSignals."
+*/
+func (s *HTTPScaffold) SetCertReloadSignal(sig os.Signal) {
+	s.certReloadSignal = sig
+}
+
+/*
+ReloadCertificates reads the certificate and key files again and starts to
+use them for new connections on the secure port. If they cannot be loaded,
+then the old certificates are kept, the "tls-certificate" health check
+reports "NotReady," and an error is returned.
+It must only be called after "Open."
+*/
+func (s *HTTPScaffold) ReloadCertificates() error {
+	if s.certLoader == nil {
+		return errors.New("Secure port is not open")
+	}
+	return s.certLoader.load()
+}
+
+/*
+createCertificateLoader loads all the certificates for the secure port.
+*/
+func (s *HTTPScaffold) createCertificateLoader() (*certificateLoader, error) {
+	l := &certificateLoader{
+		dir: s.certDirectory,
+	}
+	if s.certFile != "" || s.keyFile != "" {
+		if s.keyFile == "" || s.certFile == "" {
+			return nil, errors.New("key and certificate files must be set")
+		}
+		l.sources = append(l.sources, certificateSource{
+			certFile: s.certFile,
+			keyFile:  s.keyFile,
+			getPass:  s.keyPassword,
+		})
+	}
+	l.sources = append(l.sources, s.certificates...)
+	if len(l.sources) == 0 && l.dir == "" {
+		return nil, errors.New("key and certificate files must be set")
+	}
+
+	err := l.load()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+/*
+handleCertificates returns the list of certificates.
+*/
+func (s *HTTPScaffold) handleCertificates(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	infos := []certificateInfo{}
+	if s.certLoader != nil {
+		infos = s.certLoader.certificates()
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(infos)
+}
+
+/*
+load reads all the certificates and keys and replaces the current ones if
+they are all valid.
+*/
+func (l *certificateLoader) load() error {
+	sources, err := l.allSources()
+	modTimes := sourceModTimes(sources)
+
+	var certs []*loadedCertificate
+	if err == nil {
+		certs, err = loadCertificates(sources)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.modTimes = modTimes
+	l.lastErr = err
+	if err != nil {
+		return err
+	}
+	l.certs = certs
+	l.names = certificateNames(certs)
+	return nil
+}
+
+/*
+allSources returns the explicit certificates followed by the ones in the
+directory.
+*/
+func (l *certificateLoader) allSources() ([]certificateSource, error) {
+	sources := append([]certificateSource{}, l.sources...)
+	if l.dir == "" {
+		return sources, nil
+	}
+
+	files, err := ioutil.ReadDir(l.dir)
+	if err != nil {
+		return sources, err
+	}
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".crt" {
+			continue
+		}
+		certFile := filepath.Join(l.dir, f.Name())
+		keyFile := strings.TrimSuffix(certFile, ".crt") + ".key"
+		if _, err := os.Stat(keyFile); err != nil {
+			continue
+		}
+		sources = append(sources, certificateSource{
+			certFile: certFile,
+			keyFile:  keyFile,
+		})
+	}
+	return sources, nil
+}
+
+/*
+reloadIfChanged reloads the certificates if any of the files were added,
+removed, or modified since the last time that we tried.
+*/
+func (l *certificateLoader) reloadIfChanged() {
+	sources, err := l.allSources()
+	modTimes := sourceModTimes(sources)
+
+	l.lock.RLock()
+	changed := err != nil || len(modTimes) != len(l.modTimes)
+	for fn, t := range modTimes {
+		if lt, ok := l.modTimes[fn]; !ok || !lt.Equal(t) {
+			changed = true
+		}
+	}
+	l.lock.RUnlock()
+
+	if changed {
+		l.load()
+	}
+}
+
+/*
+watch checks for changes on the specified interval until "stop" is closed.
+*/
+func (l *certificateLoader) watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.reloadIfChanged()
+		case <-stop:
+			return
+		}
+	}
+}
+
+/*
+getCertificate picks the certificate that matches the server name that the
+client asked for, or the default certificate.
+*/
+func (l *certificateLoader) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if cert := l.names[name]; cert != nil {
+		return cert, nil
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert := l.names["*"+name[i:]]; cert != nil {
+			return cert, nil
+		}
+	}
+	return l.certs[0].cert, nil
+}
+
+/*
+certificates describes all the certificates that are being served.
+*/
+func (l *certificateLoader) certificates() []certificateInfo {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	infos := make([]certificateInfo, len(l.certs))
+	for i, c := range l.certs {
+		leaf := c.cert.Leaf
+		infos[i] = certificateInfo{
+			CertFile:  c.certFile,
+			Subject:   leaf.Subject.String(),
+			DNSNames:  leaf.DNSNames,
+			NotBefore: leaf.NotBefore.UTC(),
+			NotAfter:  leaf.NotAfter.UTC(),
+			Expires:   c.expires.UTC(),
+			Default:   i == 0,
+		}
+	}
+	return infos
+}
+
+/*
+expiryCheck returns a health check that reports certificates that will
+expire within "window." If "logf" is not nil, then it is used to log a
+warning once for each certificate that is about to expire.
+*/
+func (l *certificateLoader) expiryCheck(
+	window time.Duration, logf func(string, ...interface{})) HealthChecker {
+	return func() (HealthStatus, error) {
+		var expiring []string
+		for _, c := range l.certificates() {
+			if time.Until(c.Expires) > window {
+				continue
+			}
+			msg := fmt.Sprintf("%s expires at %s", c.CertFile, c.Expires.Format(time.RFC3339))
+			expiring = append(expiring, msg)
+			if logf != nil && l.shouldWarn(msg) {
+				logf("Warning: TLS certificate %s", msg)
+			}
+		}
+		if len(expiring) > 0 {
+			return NotReady, errors.New(strings.Join(expiring, ", "))
+		}
+		return OK, nil
+	}
+}
+
+/*
+shouldWarn returns true the first time that it is called with a message.
+*/
+func (l *certificateLoader) shouldWarn(msg string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.warned[msg] {
+		return false
+	}
+	if l.warned == nil {
+		l.warned = make(map[string]bool)
+	}
+	l.warned[msg] = true
+	return true
+}
+
+/*
+healthCheck reports whether the last attempt to load the certificates failed.
+*/
+func (l *certificateLoader) healthCheck() (HealthStatus, error) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if l.lastErr != nil {
+		return NotReady, fmt.Errorf("Cannot reload certificate: %s", l.lastErr)
+	}
+	return OK, nil
+}
+
+/*
+loadCertificates loads every source and fails if any of them fail.
+*/
+func loadCertificates(sources []certificateSource) ([]*loadedCertificate, error) {
+	if len(sources) == 0 {
+		return nil, errors.New("No certificates found")
+	}
+
+	certs := make([]*loadedCertificate, len(sources))
+	for i, src := range sources {
+		cert, err := loadKeyPair(src.certFile, src.keyFile, src.getPass)
+		var expires time.Time
+		if err == nil {
+			cert.Leaf, expires, err = parseChain(cert.Certificate)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", src.certFile, err)
+		}
+		certs[i] = &loadedCertificate{
+			certificateSource: src,
+			cert:              &cert,
+			expires:           expires,
+		}
+	}
+	return certs, nil
+}
+
+/*
+parseChain parses the leaf certificate and returns it, and also returns the
+earliest time when any certificate in the chain expires.
+*/
+func parseChain(chain [][]byte) (*x509.Certificate, time.Time, error) {
+	var leaf *x509.Certificate
+	var expires time.Time
+	for i, der := range chain {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		if i == 0 {
+			leaf = cert
+		}
+		if expires.IsZero() || cert.NotAfter.Before(expires) {
+			expires = cert.NotAfter
+		}
+	}
+	return leaf, expires, nil
+}
+
+/*
+certificateNames maps each DNS name to the first certificate that has it.
+Certificates without DNS names are mapped by their common name.
+*/
+func certificateNames(certs []*loadedCertificate) map[string]*tls.Certificate {
+	names := make(map[string]*tls.Certificate)
+	for _, c := range certs {
+		certNames := c.cert.Leaf.DNSNames
+		if len(certNames) == 0 && c.cert.Leaf.Subject.CommonName != "" {
+			certNames = []string{c.cert.Leaf.Subject.CommonName}
+		}
+		for _, n := range certNames {
+			n = strings.ToLower(n)
+			if names[n] == nil {
+				names[n] = c.cert
+			}
+		}
+	}
+	return names
+}
+
+func sourceModTimes(sources []certificateSource) map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for _, src := range sources {
+		modTimes[src.certFile] = modTime(src.certFile)
+		modTimes[src.keyFile] = modTime(src.keyFile)
+	}
+	return modTimes
+}
+
+func modTime(fn string) time.Time {
+	st, err := os.Stat(fn)
+	if err != nil {
+		return time.Time{}
+	}
+	return st.ModTime()
+}
@@ -0,0 +1,157 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/SermoDigital/jose/jwt"
+)
+
+/*
+OAuthOptions are the checks that VerifyOAuth makes on the signature
+algorithm and the claims of a token. The zero value allows every supported
+algorithm and only checks the "exp" and "nbf" claims, if they are present,
+with no clock skew.
+*/
+type OAuthOptions struct {
+	// If not empty, the "iss" claim must be one of these
+	Issuers []string
+	// If not empty, the "aud" claim must include one of these
+	Audiences []string
+	// How far the "exp" and "nbf" claims may be off from our clock
+	ClockSkew time.Duration
+	// Claims that must be present in every token
+	RequiredClaims []string
+	// If not nil, the only signature algorithms that tokens may use. The
+	// supported algorithms are RS256, RS384, RS512, PS256, PS384, PS512,
+	// ES256, ES384, ES512, and EdDSA, and all of them are allowed by
+	// default. Unsigned tokens, which use "none," are always rejected.
+	Algorithms []string
+}
+
+/*
+checkClaims returns an error that lists every check that the claims failed,
+or nil if they passed all of them. The "exp" and "nbf" claims are checked
+by the JOSE library afterwards, using the "ClockSkew."
+*/
+func (o *OAuthOptions) checkClaims(claims jwt.Claims) error {
+	var errs Errors
+
+	if len(o.Issuers) > 0 {
+		iss, _ := claims.Issuer()
+		if !containsString(o.Issuers, iss) {
+			errs = append(errs, fmt.Sprintf("Issuer %q is not allowed", iss))
+		}
+	}
+
+	if len(o.Audiences) > 0 {
+		auds, _ := claims.Audience()
+		found := false
+		for _, aud := range auds {
+			if containsString(o.Audiences, aud) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			errs = append(errs, fmt.Sprintf("Audience %q is not allowed", strings.Join(auds, ",")))
+		}
+	}
+
+	for _, name := range o.RequiredClaims {
+		if !claims.Has(name) {
+			errs = append(errs, fmt.Sprintf("Claim %q is missing", name))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+/*
+FetchSubject returns the "sub" claim from the verified token for the
+request, or an empty string if there is none.
+*/
+func FetchSubject(r *http.Request) string {
+	sub, _ := FetchClaims(r).Subject()
+	return sub
+}
+
+/*
+FetchScopes returns the scopes that were granted to the verified token for
+the request. They come from the "scope" claim, which is a string of scopes
+separated by spaces, or from the "scp" claim, which may be a string or a
+list.
+*/
+func FetchScopes(r *http.Request) []string {
+	return claimScopes(FetchClaims(r))
+}
+
+/*
+FetchExpiration returns the time that the verified token for the request
+expires. The second return value is false if there is no "exp" claim.
+*/
+func FetchExpiration(r *http.Request) (time.Time, bool) {
+	return FetchClaims(r).Expiration()
+}
+
+func claimScopes(claims jwt.Claims) []string {
+	for _, name := range []string{"scope", "scp"} {
+		switch v := claims.Get(name).(type) {
+		case string:
+			return strings.Fields(v)
+		case []string:
+			return v
+		case []interface{}:
+			var scopes []string
+			for _, s := range v {
+				if str, ok := s.(string); ok {
+					scopes = append(scopes, str)
+				}
+			}
+			return scopes
+		}
+	}
+	return nil
+}
+
+/*
+missingScopes returns the scopes that the claims do not include.
+*/
+func missingScopes(claims jwt.Claims, required []string) []string {
+	granted := claimScopes(claims)
+	var missing []string
+	for _, scope := range required {
+		if !containsString(granted, scope) {
+			missing = append(missing, scope)
+		}
+	}
+	return missing
+}
+
+func containsString(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
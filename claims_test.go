@@ -0,0 +1,214 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/SermoDigital/jose/crypto"
+	"github.com/SermoDigital/jose/jws"
+	"github.com/SermoDigital/jose/jwt"
+	"github.com/julienschmidt/httprouter"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Claims tests", func() {
+	var router *httprouter.Router
+	var oa *oauth
+
+	BeforeEach(func() {
+		oa = createLocalOAuth()
+		oa.options = OAuthOptions{
+			Issuers:        []string{"https://login.example.com", "http://github.com/apid/goscaffold"},
+			Audiences:      []string{"http://github.com/apid/goscaffold"},
+			ClockSkew:      time.Minute,
+			RequiredClaims: []string{"sub", "tenant"},
+		}
+		router = httprouter.New()
+		router.GET(oa.SSOHandler("/foobar/:param1/:param2", buslogicHandler))
+	})
+
+	It("Valid claims", func() {
+		claims := testClaims()
+		claims.Set("tenant", "acme")
+		code, _ := jwksGet(router, signClaims(claims))
+		Expect(code).Should(Equal(200))
+
+		// Within the clock skew
+		claims.SetAudience("someone-else", "http://github.com/apid/goscaffold")
+		claims.SetExpiration(time.Now().Add(-30 * time.Second))
+		claims.SetNotBefore(time.Now().Add(30 * time.Second))
+		code, _ = jwksGet(router, signClaims(claims))
+		Expect(code).Should(Equal(200))
+	})
+
+	It("Invalid claims", func() {
+		claims := testClaims()
+		claims.SetIssuer("https://evil.example.com")
+		claims.SetAudience("someone-else")
+
+		code, resp := jwksGet(router, signClaims(claims))
+		Expect(code).Should(Equal(400))
+		Expect(resp.Message).Should(Equal("Token claims are not valid. Validation failed."))
+		Expect(resp.Errors).Should(Equal([]string{
+			"Bad Request",
+			`Issuer "https://evil.example.com" is not allowed`,
+			`Audience "someone-else" is not allowed`,
+			`Claim "tenant" is missing`,
+		}))
+
+		// Outside the clock skew
+		claims = testClaims()
+		claims.Set("tenant", "acme")
+		claims.SetExpiration(time.Now().Add(-2 * time.Minute))
+		code, resp = jwksGet(router, signClaims(claims))
+		Expect(code).Should(Equal(400))
+		Expect(resp.Errors).Should(Equal([]string{"Bad Request", "Token is expired"}))
+
+		claims = testClaims()
+		claims.Set("tenant", "acme")
+		claims.SetNotBefore(time.Now().Add(2 * time.Minute))
+		code, resp = jwksGet(router, signClaims(claims))
+		Expect(code).Should(Equal(400))
+		Expect(resp.Errors).Should(Equal([]string{"Bad Request", "Token is not valid yet"}))
+	})
+
+	It("Default options", func() {
+		oa.options = OAuthOptions{}
+		claims := testClaims()
+		claims.SetIssuer("https://evil.example.com")
+		code, _ := jwksGet(router, signClaims(claims))
+		Expect(code).Should(Equal(200))
+
+		claims.SetExpiration(time.Now().Add(-time.Second))
+		code, resp := jwksGet(router, signClaims(claims))
+		Expect(code).Should(Equal(400))
+		Expect(resp.Errors).Should(Equal([]string{"Bad Request", "Token is expired"}))
+	})
+
+	It("Fetch claims", func() {
+		var claims jwt.Claims
+		var sub string
+		var scopes []string
+		var exp time.Time
+		var hasExp bool
+		router.GET(oa.SSOHandler("/claims", func(w http.ResponseWriter, r *http.Request) {
+			claims = FetchClaims(r)
+			sub = FetchSubject(r)
+			scopes = FetchScopes(r)
+			exp, hasExp = FetchExpiration(r)
+		}))
+
+		expected := time.Now().Add(time.Hour).Truncate(time.Second)
+		c := testClaims()
+		c.Set("tenant", "acme")
+		c.Set("scope", "read  write")
+		c.SetExpiration(expected)
+		code, _ := jwksGetPath(router, "/claims", signClaims(c))
+		Expect(code).Should(Equal(200))
+		Expect(claims.Get("tenant")).Should(Equal("acme"))
+		Expect(sub).Should(Equal("http://github.com/apid/goscaffold"))
+		Expect(scopes).Should(Equal([]string{"read", "write"}))
+		Expect(hasExp).Should(BeTrue())
+		Expect(exp.Equal(expected)).Should(BeTrue())
+
+		req := httptest.NewRequest("GET", "/", nil)
+		Expect(FetchClaims(req)).Should(BeNil())
+		Expect(FetchSubject(req)).Should(BeEmpty())
+		Expect(FetchScopes(req)).Should(BeEmpty())
+		_, hasExp = FetchExpiration(req)
+		Expect(hasExp).Should(BeFalse())
+	})
+
+	It("Scope authorization", func() {
+		router.GET(oa.SSOHandlerWithScopes("/write", []string{"read", "write"}, okHandler))
+
+		c := testClaims()
+		c.Set("tenant", "acme")
+		c.Set("scope", "read write admin")
+		code, _ := jwksGetPath(router, "/write", signClaims(c))
+		Expect(code).Should(Equal(200))
+
+		c.Set("scope", "read")
+		code, resp := jwksGetPath(router, "/write", signClaims(c))
+		Expect(code).Should(Equal(403))
+		Expect(resp.Status).Should(Equal("Forbidden"))
+		Expect(resp.Message).Should(Equal("Token is missing required scopes: write"))
+
+		delete(c, "scope")
+		c.Set("scp", []string{"write"})
+		code, resp = jwksGetPath(router, "/write", signClaims(c))
+		Expect(code).Should(Equal(403))
+		Expect(resp.Message).Should(Equal("Token is missing required scopes: read"))
+
+		// Invalid tokens are still rejected first
+		code, _ = jwksGetPath(router, "/write", []byte("DEADBEEF"))
+		Expect(code).Should(Equal(400))
+	})
+
+	It("Predicate authorization", func() {
+		router.GET(oa.SSOHandlerWithPredicate("/admin", func(claims jwt.Claims) bool {
+			return claims.Get("role") == "admin"
+		}, okHandler))
+
+		c := testClaims()
+		c.Set("tenant", "acme")
+		c.Set("role", "admin")
+		code, _ := jwksGetPath(router, "/admin", signClaims(c))
+		Expect(code).Should(Equal(200))
+
+		c.Set("role", "user")
+		code, resp := jwksGetPath(router, "/admin", signClaims(c))
+		Expect(code).Should(Equal(403))
+		Expect(resp.Message).Should(Equal("Token is not authorized for this request"))
+		Expect(resp.Errors).Should(Equal([]string{"Forbidden"}))
+	})
+
+	It("Scope claims", func() {
+		Expect(claimScopes(jwt.Claims{"scope": "a b"})).Should(Equal([]string{"a", "b"}))
+		Expect(claimScopes(jwt.Claims{"scp": "a"})).Should(Equal([]string{"a"}))
+		Expect(claimScopes(jwt.Claims{"scp": []interface{}{"a", "b"}})).Should(Equal([]string{"a", "b"}))
+		Expect(claimScopes(jwt.Claims{"sub": "a"})).Should(BeEmpty())
+	})
+})
+
+func okHandler(w http.ResponseWriter, r *http.Request) {
+}
+
+/*
+testClaims returns the claims that are in the tokens from "createJWT."
+*/
+func testClaims() jws.Claims {
+	claims := jws.Claims{}
+	now := time.Now()
+	claims.SetAudience("http://github.com/apid/goscaffold")
+	claims.SetIssuer("http://github.com/apid/goscaffold")
+	claims.SetSubject("http://github.com/apid/goscaffold")
+	claims.SetIssuedAt(now)
+	claims.SetNotBefore(now)
+	claims.SetExpiration(now.Add(time.Hour))
+	return claims
+}
+
+/*
+signClaims creates a token with the claims that is signed by the test key.
+*/
+func signClaims(claims jws.Claims) []byte {
+	return signTestClaims(claims, crypto.SigningMethodRS256, testSigningKey(), "")
+}
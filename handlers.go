@@ -15,14 +15,33 @@
 package goscaffold
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
+	"net"
 	"net/http"
 	"net/http/pprof"
+	"sync/atomic"
+	"time"
+)
+
+type contextKey int
+
+/*
+Keys for values that the scaffold stores in the request context.
+*/
+const (
+	accessLogKey contextKey = iota
+	requestIDKey
+	clientIdentityKey
+	claimsKey
 )
 
 /*
 requestHandler handles all requests and stops them if we are marked down.
+The context of each request is cancelled if the grace period expires
+before the request completes.
 */
 type requestHandler struct {
 	s     *HTTPScaffold
@@ -30,13 +49,106 @@ type requestHandler struct {
 }
 
 func (h *requestHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	reqID, req := h.s.assignRequestID(req)
+	resp.Header().Set(h.s.requestIDHeader, reqID)
+	if id := clientIdentity(req); id != nil {
+		req = req.WithContext(context.WithValue(req.Context(), clientIdentityKey, id))
+	}
+	rr := &responseRecorder{ResponseWriter: resp, requestID: reqID}
+
+	var logEntry *AccessLogEntry
+	if h.s.accessLog != nil {
+		logEntry, req = newAccessLogEntry(req, start)
+	}
+
 	startErr := h.s.tracker.start()
 	if startErr == nil {
-		h.child.ServeHTTP(resp, req)
-		h.s.tracker.end()
+		h.serveTracked(rr, req)
 	} else {
-		writeUnavailable(resp, req, NotReady, startErr)
+		writeUnavailable(rr, req, NotReady, startErr)
 	}
+
+	duration := time.Since(start)
+	h.s.metrics.record(rr.statusCode(), duration)
+	if logEntry != nil {
+		logEntry.Status = rr.statusCode()
+		logEntry.Bytes = rr.bytes
+		logEntry.Duration = duration
+		h.s.accessLog.write(logEntry)
+	}
+}
+
+/*
+serveTracked calls the child handler for a request that the tracker has
+counted. The count is decremented even if the handler panics.
+*/
+func (h *requestHandler) serveTracked(resp http.ResponseWriter, req *http.Request) {
+	defer h.s.tracker.end()
+	ctx, cancel := h.s.tracker.requestContext(req.Context())
+	defer cancel()
+	h.child.ServeHTTP(resp, req.WithContext(ctx))
+}
+
+/*
+responseRecorder wraps a ResponseWriter so that we can find out what
+status code the handler returned and how much it wrote.
+*/
+type responseRecorder struct {
+	http.ResponseWriter
+	status    int
+	bytes     int64
+	requestID string
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(buf []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(buf)
+	r.bytes += int64(n)
+	return n, err
+}
+
+/*
+Flush supports handlers that stream their responses.
+*/
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+/*
+Hijack supports handlers that take over the connection, such as WebSockets.
+*/
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Connection cannot be hijacked")
+	}
+	return h.Hijack()
+}
+
+/*
+Unwrap allows http.ResponseController to reach the original ResponseWriter.
+*/
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *responseRecorder) statusCode() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
 }
 
 /*
@@ -79,24 +191,22 @@ func (s *HTTPScaffold) createManagementHandler() *managementHandler {
 	if s.readyPath != "" {
 		h.mux.HandleFunc(s.readyPath, s.handleReady)
 	}
-	if s.markdownPath != "" {
-		h.mux.HandleFunc(s.markdownPath, s.handleMarkdown)
+	if s.startupPath != "" {
+		h.mux.HandleFunc(s.startupPath, s.handleStartup)
 	}
-	return h
-}
-
-func (s *HTTPScaffold) callHealthCheck() (HealthStatus, error) {
-	if s.healthCheck == nil {
-		return OK, nil
+	if s.metricsPath != "" {
+		h.mux.HandleFunc(s.metricsPath, s.handleMetrics)
+	}
+	if s.certificatesPath != "" {
+		h.mux.HandleFunc(s.certificatesPath, s.handleCertificates)
 	}
-	status, err := s.healthCheck()
-	if status == OK {
-		return OK, nil
+	if s.markdownPath != "" {
+		h.mux.HandleFunc(s.markdownPath, s.handleMarkdown)
 	}
-	if err == nil {
-		return status, errors.New(status.String())
+	if s.markupPath != "" {
+		h.mux.HandleFunc(s.markupPath, s.handleMarkup)
 	}
-	return status, err
+	return h
 }
 
 /*
@@ -108,12 +218,12 @@ func (s *HTTPScaffold) handleHealth(resp http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	status, healthErr := s.callHealthCheck()
+	report := s.currentHealth()
 
-	if status == Failed {
-		writeUnavailable(resp, req, status, healthErr)
+	if report.status == Failed {
+		writeHealthReport(resp, req, http.StatusServiceUnavailable, report)
 	} else {
-		resp.WriteHeader(http.StatusOK)
+		writeHealthReport(resp, req, http.StatusOK, report)
 	}
 }
 
@@ -127,19 +237,44 @@ func (s *HTTPScaffold) handleReady(resp http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	status, healthErr := s.callHealthCheck()
-	if status == OK {
-		healthErr = s.tracker.markedDown()
-		if healthErr != nil {
-			status = NotReady
+	report := s.currentHealth()
+	if report.status == OK {
+		report.err = s.tracker.markedDown()
+		if report.err != nil {
+			report.status = NotReady
+		} else if s.isStarting() {
+			report.status = Starting
+			report.err = ErrStarting
 		}
 	}
 
-	if status == OK {
-		resp.WriteHeader(http.StatusOK)
+	if report.status == OK {
+		writeHealthReport(resp, req, http.StatusOK, report)
 	} else {
-		writeUnavailable(resp, req, status, healthErr)
+		writeHealthReport(resp, req, http.StatusServiceUnavailable, report)
+	}
+}
+
+/*
+handleStartup fails until the application tells us that it has started, and
+then works like handleHealth.
+*/
+func (s *HTTPScaffold) handleStartup(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.isStarting() {
+		writeHealthReport(resp, req, http.StatusServiceUnavailable,
+			&healthReport{status: Starting, err: ErrStarting})
+		return
 	}
+	s.handleHealth(resp, req)
+}
+
+func (s *HTTPScaffold) isStarting() bool {
+	return atomic.LoadInt32(&s.starting) != 0
 }
 
 /*
@@ -152,9 +287,22 @@ func (s *HTTPScaffold) handleMarkdown(resp http.ResponseWriter, req *http.Reques
 	}
 
 	req.Body.Close()
-	s.tracker.markDown()
-	if s.markdownHandler != nil {
-		s.markdownHandler()
+	s.MarkDown()
+}
+
+/*
+handleMarkup handles a request to mark the server back up.
+*/
+func (s *HTTPScaffold) handleMarkup(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != s.markupMethod {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	req.Body.Close()
+	err := s.MarkUp()
+	if err != nil {
+		writeUnavailable(resp, req, NotReady, err)
 	}
 }
 
@@ -162,20 +310,38 @@ func writeUnavailable(
 	resp http.ResponseWriter, req *http.Request,
 	stat HealthStatus, err error) {
 
+	writeHealthReport(resp, req, http.StatusServiceUnavailable,
+		&healthReport{status: stat, err: err, RequestID: FetchRequestID(req)})
+}
+
+/*
+writeHealthReport writes the report as JSON if the client asked for it.
+Otherwise it writes the reason for the failure as plain text, and nothing
+at all if the status code is 200.
+*/
+func writeHealthReport(
+	resp http.ResponseWriter, req *http.Request,
+	code int, report *healthReport) {
+
 	mt := SelectMediaType(req, []string{"text/plain", "application/json"})
 
-	resp.WriteHeader(http.StatusServiceUnavailable)
 	switch mt {
 	case "application/json":
-		re := map[string]string{
-			"status": stat.String(),
-			"reason": err.Error(),
+		report.Status = report.status.String()
+		if report.err != nil {
+			report.Reason = report.err.Error()
 		}
-		buf, _ := json.Marshal(&re)
+		buf, _ := json.Marshal(report)
 		resp.Header().Set("Content-Type", mt)
+		resp.WriteHeader(code)
 		resp.Write(buf)
 	default:
+		if code == http.StatusOK {
+			resp.WriteHeader(code)
+			return
+		}
 		resp.Header().Set("Content-Type", "text/plain")
-		resp.Write([]byte(err.Error()))
+		resp.WriteHeader(code)
+		resp.Write([]byte(report.err.Error()))
 	}
 }
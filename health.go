@@ -0,0 +1,314 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+healthCheck is a named health check that was registered using
+"AddHealthCheck."
+*/
+type healthCheck struct {
+	name     string
+	checker  HealthChecker
+	timeout  time.Duration
+	critical bool
+}
+
+/*
+healthResult is the outcome of running a single named check.
+*/
+type healthResult struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Critical bool   `json:"critical"`
+	Latency  string `json:"latency"`
+	Error    string `json:"error,omitempty"`
+	status   HealthStatus
+	err      error
+	latency  time.Duration
+}
+
+/*
+healthReport is the outcome of running all the health checks. It is
+returned as JSON by the health and ready paths.
+*/
+type healthReport struct {
+	Status       string            `json:"status"`
+	Reason       string            `json:"reason,omitempty"`
+	Checked      string            `json:"checked,omitempty"`
+	Stale        bool              `json:"stale,omitempty"`
+	RequestID    string            `json:"requestId,omitempty"`
+	Checks       []*healthResult   `json:"checks,omitempty"`
+	Certificates []certificateInfo `json:"certificates,omitempty"`
+	status       HealthStatus
+	err          error
+}
+
+/*
+healthCache holds the last report when the health checks are run in the
+background.
+*/
+type healthCache struct {
+	lock       sync.Mutex
+	report     *healthReport
+	roundStart time.Time
+}
+
+/*
+AddHealthCheck registers a named check that will be run along with the
+function passed to "SetHealthChecker" every time that the "healthPath" or
+"readyPath" is invoked. The result of each check is reported in the JSON
+version of those paths. If "timeout" is greater than zero, then a check that
+takes longer than that is treated as "Failed." If "critical" is true, then
+the status of the check affects the status of the whole server. Otherwise,
+it is only reported. It must be called before "Listen."
+*/
+func (s *HTTPScaffold) AddHealthCheck(
+	name string, timeout time.Duration, critical bool, c HealthChecker) {
+	s.healthChecks = append(s.healthChecks, &healthCheck{
+		name:     name,
+		checker:  c,
+		timeout:  timeout,
+		critical: critical,
+	})
+}
+
+/*
+replaceHealthCheck is like AddHealthCheck, but it replaces the check with
+the same name if there is one. It is used for the checks that the scaffold
+adds itself, so that calling "Open" again does not add them twice.
+*/
+func (s *HTTPScaffold) replaceHealthCheck(
+	name string, timeout time.Duration, critical bool, c HealthChecker) {
+	for _, hc := range s.healthChecks {
+		if hc.name == name {
+			hc.checker = c
+			hc.timeout = timeout
+			hc.critical = critical
+			return
+		}
+	}
+	s.AddHealthCheck(name, timeout, critical, c)
+}
+
+/*
+SetHealthCheckInterval causes the health checker and all the named checks
+to be run in the background every "interval" rather than every time that
+the "healthPath" or "readyPath" is invoked. Those paths will return the
+result of the last run instead, including the time when it completed.
+If a run has not completed after "deadline," then the result is marked as
+stale, and the "readyPath" will fail until the run completes. A deadline
+of zero means that results never become stale.
+It must be called before "Listen."
+*/
+func (s *HTTPScaffold) SetHealthCheckInterval(interval, deadline time.Duration) {
+	s.healthInterval = interval
+	s.healthDeadline = deadline
+}
+
+func (s *HTTPScaffold) callHealthCheck() (HealthStatus, error) {
+	if s.healthCheck == nil {
+		return OK, nil
+	}
+	return normalizeHealth(s.healthCheck())
+}
+
+/*
+checkHealth runs the health checker and all the named checks in parallel
+and combines them into a single report. The status of the report is the
+worst status of the health checker and all the critical checks.
+*/
+func (s *HTTPScaffold) checkHealth() *healthReport {
+	report := &healthReport{
+		Checks: make([]*healthResult, len(s.healthChecks)),
+	}
+
+	wg := &sync.WaitGroup{}
+	for i, c := range s.healthChecks {
+		wg.Add(1)
+		go func(i int, c *healthCheck) {
+			report.Checks[i] = c.run()
+			wg.Done()
+		}(i, c)
+	}
+	report.status, report.err = s.callHealthCheck()
+	wg.Wait()
+
+	if s.certLoader != nil {
+		report.Certificates = s.certLoader.certificates()
+	}
+
+	for _, r := range report.Checks {
+		if r.Critical && r.status.severity() > report.status.severity() {
+			report.status = r.status
+			report.err = fmt.Errorf("%s: %s", r.Name, r.err)
+		}
+	}
+	return report
+}
+
+/*
+currentHealth returns the cached report if the checks are running in the
+background, and otherwise runs the checks right now.
+*/
+func (s *HTTPScaffold) currentHealth() *healthReport {
+	if s.healthInterval <= 0 {
+		return s.checkHealth()
+	}
+	return s.healthCache.get(s.healthDeadline)
+}
+
+/*
+runHealthChecks runs the checks on the configured interval until "stop"
+is closed.
+*/
+func (s *HTTPScaffold) runHealthChecks(stop <-chan struct{}) {
+	ticker := time.NewTicker(s.healthInterval)
+	defer ticker.Stop()
+
+	for {
+		s.healthCache.startRound()
+		s.healthCache.update(s.checkHealth())
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (c *healthCache) startRound() {
+	c.lock.Lock()
+	c.roundStart = time.Now()
+	c.lock.Unlock()
+}
+
+func (c *healthCache) update(r *healthReport) {
+	r.Checked = time.Now().UTC().Format(time.RFC3339Nano)
+	c.lock.Lock()
+	c.report = r
+	c.roundStart = time.Time{}
+	c.lock.Unlock()
+}
+
+/*
+get returns a copy of the last report, which the caller may modify.
+*/
+func (c *healthCache) get(deadline time.Duration) *healthReport {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.report == nil {
+		return &healthReport{
+			status: NotReady,
+			err:    errors.New("Health check has not completed"),
+		}
+	}
+
+	r := *c.report
+	if deadline > 0 && !c.roundStart.IsZero() &&
+		time.Since(c.roundStart) > deadline {
+		r.Stale = true
+		if r.status == OK {
+			r.status = NotReady
+			r.err = fmt.Errorf("Health check has not completed in %s", deadline)
+		}
+	}
+	return &r
+}
+
+func (c *healthCheck) run() *healthResult {
+	start := time.Now()
+	status, err := normalizeHealth(c.call())
+	latency := time.Since(start)
+	r := &healthResult{
+		Name:     c.name,
+		Status:   status.String(),
+		Critical: c.critical,
+		Latency:  latency.String(),
+		status:   status,
+		err:      err,
+		latency:  latency,
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+/*
+call invokes the checker. If it takes longer than the timeout then it is
+left to complete in the background.
+*/
+func (c *healthCheck) call() (HealthStatus, error) {
+	if c.timeout <= 0 {
+		return c.checker()
+	}
+
+	type result struct {
+		status HealthStatus
+		err    error
+	}
+	resultChan := make(chan result, 1)
+	go func() {
+		status, err := c.checker()
+		resultChan <- result{status: status, err: err}
+	}()
+
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	select {
+	case r := <-resultChan:
+		return r.status, r.err
+	case <-timer.C:
+		return Failed, fmt.Errorf("Timed out after %s", c.timeout)
+	}
+}
+
+/*
+severity orders the statuses from best to worst.
+*/
+func (h HealthStatus) severity() int {
+	switch h {
+	case OK:
+		return 0
+	case Starting:
+		return 1
+	case NotReady:
+		return 2
+	default:
+		return 3
+	}
+}
+
+/*
+normalizeHealth makes sure that there is an error for every status that is
+not OK and no error otherwise.
+*/
+func normalizeHealth(status HealthStatus, err error) (HealthStatus, error) {
+	if status == OK {
+		return OK, nil
+	}
+	if err == nil {
+		return status, errors.New(status.String())
+	}
+	return status, err
+}
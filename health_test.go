@@ -0,0 +1,155 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Health check tests", func() {
+	okCheck := func() (HealthStatus, error) {
+		return OK, nil
+	}
+	failedCheck := func() (HealthStatus, error) {
+		return Failed, errors.New("Broken")
+	}
+	slowCheck := func() (HealthStatus, error) {
+		time.Sleep(time.Second)
+		return OK, nil
+	}
+
+	It("No checks", func() {
+		s := CreateHTTPScaffold()
+		r := s.checkHealth()
+		Expect(r.status).Should(Equal(OK))
+		Expect(r.err).Should(BeNil())
+		Expect(r.Checks).Should(BeEmpty())
+	})
+
+	It("Named checks", func() {
+		s := CreateHTTPScaffold()
+		s.AddHealthCheck("database", 0, true, okCheck)
+		s.AddHealthCheck("cache", 0, false, failedCheck)
+		r := s.checkHealth()
+		Expect(r.status).Should(Equal(OK))
+		Expect(r.Checks).Should(HaveLen(2))
+		Expect(r.Checks[0].Name).Should(Equal("database"))
+		Expect(r.Checks[0].Status).Should(Equal("OK"))
+		Expect(r.Checks[0].Error).Should(BeEmpty())
+		Expect(r.Checks[1].Name).Should(Equal("cache"))
+		Expect(r.Checks[1].Status).Should(Equal("Failed"))
+		Expect(r.Checks[1].Error).Should(Equal("Broken"))
+	})
+
+	It("Critical check fails", func() {
+		s := CreateHTTPScaffold()
+		s.AddHealthCheck("database", 0, true, failedCheck)
+		s.AddHealthCheck("cache", 0, false, okCheck)
+		r := s.checkHealth()
+		Expect(r.status).Should(Equal(Failed))
+		Expect(r.err).Should(MatchError("database: Broken"))
+	})
+
+	It("Check timeout", func() {
+		s := CreateHTTPScaffold()
+		s.AddHealthCheck("upstream", 100*time.Millisecond, true, slowCheck)
+		start := time.Now()
+		r := s.checkHealth()
+		Expect(time.Since(start)).Should(BeNumerically("<", time.Second))
+		Expect(r.status).Should(Equal(Failed))
+		Expect(r.Checks[0].Error).Should(Equal("Timed out after 100ms"))
+	})
+	It("Background checks", func() {
+		var calls int32
+		s := CreateHTTPScaffold()
+		s.SetHealthCheckInterval(100*time.Millisecond, 0)
+		s.AddHealthCheck("counter", 0, true, func() (HealthStatus, error) {
+			atomic.AddInt32(&calls, 1)
+			return OK, nil
+		})
+
+		r := s.currentHealth()
+		Expect(r.status).Should(Equal(NotReady))
+		Expect(r.err).Should(MatchError("Health check has not completed"))
+
+		stop := make(chan struct{})
+		defer close(stop)
+		go s.runHealthChecks(stop)
+
+		Eventually(func() HealthStatus {
+			return s.currentHealth().status
+		}).Should(Equal(OK))
+		r = s.currentHealth()
+		Expect(r.Checked).ShouldNot(BeEmpty())
+		Expect(r.Stale).Should(BeFalse())
+
+		// Probes do not cause more checks
+		before := atomic.LoadInt32(&calls)
+		for i := 0; i < 10; i++ {
+			s.currentHealth()
+		}
+		Expect(atomic.LoadInt32(&calls) - before).Should(BeNumerically("<=", 1))
+		Eventually(func() int32 {
+			return atomic.LoadInt32(&calls)
+		}).Should(BeNumerically(">", before+1))
+	})
+
+	It("Stale background checks", func() {
+		var hang int32
+		release := make(chan struct{})
+		s := CreateHTTPScaffold()
+		s.SetHealthCheckInterval(50*time.Millisecond, 200*time.Millisecond)
+		s.AddHealthCheck("hanging", 0, true, func() (HealthStatus, error) {
+			if atomic.LoadInt32(&hang) != 0 {
+				<-release
+			}
+			return OK, nil
+		})
+
+		stop := make(chan struct{})
+		defer close(stop)
+		go s.runHealthChecks(stop)
+
+		Eventually(func() HealthStatus {
+			return s.currentHealth().status
+		}).Should(Equal(OK))
+
+		atomic.StoreInt32(&hang, 1)
+		Eventually(func() bool {
+			return s.currentHealth().Stale
+		}).Should(BeTrue())
+		r := s.currentHealth()
+		Expect(r.status).Should(Equal(NotReady))
+		Expect(r.err).Should(MatchError("Health check has not completed in 200ms"))
+
+		atomic.StoreInt32(&hang, 0)
+		close(release)
+		Eventually(func() bool {
+			return s.currentHealth().Stale
+		}).Should(BeFalse())
+		Expect(s.currentHealth().status).Should(Equal(OK))
+	})
+	It("Status strings", func() {
+		Expect(OK.String()).Should(Equal("OK"))
+		Expect(NotReady.String()).Should(Equal("NotReady"))
+		Expect(Failed.String()).Should(Equal("Failed"))
+		Expect(Starting.String()).Should(Equal("Starting"))
+	})
+})
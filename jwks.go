@@ -0,0 +1,279 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+jsonWebKey is a single key from a JWKS document, as described in RFC 7517.
+*/
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+/*
+keyDocument is what the key URL returns. It is either a JWKS document with
+a list of keys, or a single key in the older format.
+*/
+type keyDocument struct {
+	Keys []jsonWebKey `json:"keys"`
+	ssoKey
+}
+
+/*
+publicKey is an RSA, ECDSA, or Ed25519 public key. If "alg" is set, then
+the key may only be used with that signature algorithm.
+*/
+type publicKey struct {
+	key interface{}
+	alg string
+}
+
+/*
+publicKeys maps each key ID to its key. A key with no ID is stored using
+an empty string.
+*/
+type publicKeys map[string]*publicKey
+
+/*
+errUnsupportedKey is returned for keys of a type that we cannot use to
+verify signatures.
+*/
+var errUnsupportedKey = errors.New("Unsupported key type")
+
+/*
+keyClient fetches the public keys. It has a timeout so that a slow key URL
+cannot hold up the requests that are waiting for a key.
+*/
+var keyClient = &http.Client{Timeout: 10 * time.Second}
+
+/*
+fetchPublicKeys loads the public keys from the URL. Keys that are not
+used for signatures, or that are of a type that we do not support, are
+skipped.
+*/
+func fetchPublicKeys(keyURL string) (publicKeys, error) {
+	r, err := keyClient.Get(keyURL)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Cannot fetch public keys: %s", r.Status)
+	}
+
+	doc := &keyDocument{}
+	err = json.NewDecoder(r.Body).Decode(doc)
+	if err != nil {
+		return nil, err
+	}
+	return doc.publicKeys()
+}
+
+func (d *keyDocument) publicKeys() (publicKeys, error) {
+	if d.Keys == nil {
+		/* Older single key format */
+		pk, err := parsePublicKeyPEM([]byte(d.Value))
+		if err != nil {
+			return nil, err
+		}
+		return publicKeys{"": &publicKey{key: pk}}, nil
+	}
+
+	keys := publicKeys{}
+	for _, k := range d.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pk, err := k.publicKey()
+		if err == errUnsupportedKey {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key %q: %s", k.Kid, err)
+		}
+		keys[k.Kid] = &publicKey{key: pk, alg: k.Alg}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("No usable public keys found")
+	}
+	return keys, nil
+}
+
+func (k *jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		return k.rsaPublicKey()
+	case "EC":
+		return k.ecPublicKey()
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, errUnsupportedKey
+		}
+		x, err := decodeBase64URL(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("Invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, errUnsupportedKey
+	}
+}
+
+func (k *jsonWebKey) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := decodeBase64URL(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := decodeBase64URL(k.E)
+	if err != nil {
+		return nil, err
+	}
+	if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+		return nil, errors.New("Invalid RSA modulus or exponent")
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
+
+func (k *jsonWebKey) ecPublicKey() (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, errUnsupportedKey
+	}
+	x, err := decodeBase64URL(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := decodeBase64URL(k.Y)
+	if err != nil {
+		return nil, err
+	}
+	size := (curve.Params().BitSize + 7) / 8
+	if len(x) != size || len(y) != size {
+		return nil, errors.New("Invalid EC point size")
+	}
+	pk := &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}
+	if !curve.IsOnCurve(pk.X, pk.Y) {
+		return nil, errors.New("EC point is not on the curve")
+	}
+	return pk, nil
+}
+
+/*
+parsePublicKeyPEM parses an RSA, ECDSA, or Ed25519 public key, or a
+certificate that contains one.
+*/
+func parsePublicKeyPEM(buf []byte) (interface{}, error) {
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, errors.New("Public key is not in PEM format")
+	}
+
+	var pk interface{}
+	if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+		pk = cert.PublicKey
+	} else if pk, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+		pk, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch pk.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+		return pk, nil
+	default:
+		return nil, errUnsupportedKey
+	}
+}
+
+/*
+find returns the key for the key ID in a token. If the token has no key ID,
+then it matches a key without one, or the only key if there is just one.
+A key in the older single key format, which has no ID, is used for tokens
+with any key ID.
+*/
+func (k publicKeys) find(kid string) *publicKey {
+	if pk := k[kid]; pk != nil {
+		return pk
+	}
+	if pk := k.legacyKey(); pk != nil {
+		return pk
+	}
+	if kid == "" && len(k) == 1 {
+		for _, pk := range k {
+			return pk
+		}
+	}
+	return nil
+}
+
+/*
+legacyKey returns the key if there is just one and it has no ID, as when
+it was loaded from the older single key format. Otherwise it returns nil.
+*/
+func (k publicKeys) legacyKey() *publicKey {
+	if len(k) != 1 {
+		return nil
+	}
+	return k[""]
+}
+
+/*
+decodeBase64URL decodes base64url with or without padding.
+*/
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
@@ -0,0 +1,215 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SermoDigital/jose/crypto"
+	"github.com/julienschmidt/httprouter"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("JWKS tests", func() {
+	var testKey *rsa.PublicKey
+	var otherKey *rsa.PublicKey
+
+	BeforeEach(func() {
+		certBytes, err := ioutil.ReadFile("./testkeys/jwtcert.pem")
+		Expect(err).Should(Succeed())
+		testKey, err = crypto.ParseRSAPublicKeyFromPEM(certBytes)
+		Expect(err).Should(Succeed())
+		priv, err := rsa.GenerateKey(rand.Reader, 1024)
+		Expect(err).Should(Succeed())
+		otherKey = &priv.PublicKey
+	})
+
+	It("Parse JWKS", func() {
+		doc := &keyDocument{}
+		err := json.Unmarshal([]byte(`{"keys":[`+
+			jwkJSON("one", "RS256", "", otherKey)+`,`+
+			jwkJSON("two", "RS256", "sig", testKey)+`,`+
+			jwkJSON("three", "RS256", "enc", testKey)+`,`+
+			`{"kty":"oct","kid":"four","k":"c2VjcmV0"}]}`), doc)
+		Expect(err).Should(Succeed())
+		keys, err := doc.publicKeys()
+		Expect(err).Should(Succeed())
+		Expect(keys).Should(HaveLen(2))
+		Expect(keys["one"]).Should(Equal(&publicKey{key: otherKey, alg: "RS256"}))
+		Expect(keys["two"]).Should(Equal(&publicKey{key: testKey, alg: "RS256"}))
+
+		Expect(keys.find("two")).Should(Equal(keys["two"]))
+		Expect(keys.find("three")).Should(BeNil())
+		Expect(keys.find("")).Should(BeNil())
+		one := &publicKey{key: testKey}
+		Expect(publicKeys{"one": one}.find("")).Should(Equal(one))
+		Expect(publicKeys{"one": one}.find("other")).Should(BeNil())
+		Expect(publicKeys{"": one}.find("other")).Should(Equal(one))
+
+		err = json.Unmarshal([]byte(`{"keys":[{"kty":"oct","kid":"four"}]}`), doc)
+		Expect(err).Should(Succeed())
+		_, err = doc.publicKeys()
+		Expect(err).ShouldNot(Succeed())
+	})
+
+	It("Parse single key", func() {
+		certBytes, err := ioutil.ReadFile("./testkeys/jwtcert.pem")
+		Expect(err).Should(Succeed())
+		var fetches int32
+		svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&fetches, 1)
+			json.NewEncoder(w).Encode(&ssoKey{
+				Alg:   "SHA256withRSA",
+				Value: string(certBytes),
+			})
+		}))
+		defer svr.Close()
+
+		keys, err := fetchPublicKeys(svr.URL)
+		Expect(err).Should(Succeed())
+		Expect(keys).Should(Equal(publicKeys{"": &publicKey{key: testKey}}))
+
+		// Tokens with a key ID may still be checked against the key, without
+		// fetching it again
+		oa := CreateHTTPScaffold().CreateOAuth(svr.URL).(*oauth)
+		oa.refetchInterval = 0
+		router := httprouter.New()
+		router.GET(oa.SSOHandler("/foobar/:param1/:param2", buslogicHandler))
+		code, _ := jwksGet(router, createKeyedJWT("somekid"))
+		Expect(code).Should(Equal(200))
+		code, _ = jwksGet(router, createJWT())
+		Expect(code).Should(Equal(200))
+		Expect(atomic.LoadInt32(&fetches)).Should(BeEquivalentTo(2))
+	})
+
+	It("Select key by ID", func() {
+		var fetches int32
+		var lock sync.Mutex
+		doc := `{"keys":[` + jwkJSON("old", "RS256", "sig", otherKey) + `]}`
+		svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&fetches, 1)
+			lock.Lock()
+			defer lock.Unlock()
+			w.Write([]byte(doc))
+		}))
+		defer svr.Close()
+
+		scaf := CreateHTTPScaffold()
+		oa := scaf.CreateOAuth(svr.URL).(*oauth)
+		Expect(atomic.LoadInt32(&fetches)).Should(BeEquivalentTo(1))
+		router := httprouter.New()
+		router.GET(oa.SSOHandler("/foobar/:param1/:param2", buslogicHandler))
+
+		// Wrong key for the token
+		code, resp := jwksGet(router, createKeyedJWT("old"))
+		Expect(code).Should(Equal(400))
+		Expect(resp.Message).ShouldNot(BeEmpty())
+		Expect(atomic.LoadInt32(&fetches)).Should(BeEquivalentTo(1))
+
+		// Keys were rotated since the last fetch
+		lock.Lock()
+		doc = `{"keys":[` + jwkJSON("old", "RS256", "sig", otherKey) + `,` +
+			jwkJSON("new", "RS256", "sig", testKey) + `]}`
+		lock.Unlock()
+		code, resp = jwksGet(router, createKeyedJWT("new"))
+		Expect(code).Should(Equal(400))
+		Expect(resp.Message).Should(Equal(`No public key for key ID "new". Validation failed.`))
+		Expect(atomic.LoadInt32(&fetches)).Should(BeEquivalentTo(1))
+
+		oa.refetchInterval = 0
+		code, _ = jwksGet(router, createKeyedJWT("new"))
+		Expect(code).Should(Equal(200))
+		Expect(atomic.LoadInt32(&fetches)).Should(BeEquivalentTo(2))
+
+		// Unknown key IDs are limited to one fetch per interval
+		oa.refetchInterval = time.Hour
+		for i := 0; i < 3; i++ {
+			code, resp = jwksGet(router, createKeyedJWT("unknown"))
+			Expect(code).Should(Equal(400))
+			Expect(resp.Message).Should(Equal(
+				`No public key for key ID "unknown". Validation failed.`))
+		}
+		Expect(atomic.LoadInt32(&fetches)).Should(BeEquivalentTo(2))
+
+		// More than one key and no key ID
+		code, resp = jwksGet(router, createJWT())
+		Expect(code).Should(Equal(400))
+		Expect(resp.Message).Should(Equal("Token has no key ID. Validation failed."))
+	})
+})
+
+/*
+jwkJSON returns an RSA, ECDSA, or Ed25519 public key in JWK format.
+*/
+func jwkJSON(kid, alg, use string, key interface{}) string {
+	jwk := &jsonWebKey{
+		Kid: kid,
+		Alg: alg,
+		Use: use,
+	}
+	switch pk := key.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pk.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pk.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (pk.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = pk.Curve.Params().Name
+		jwk.X = base64.RawURLEncoding.EncodeToString(pk.X.FillBytes(make([]byte, size)))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(pk.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(pk)
+	}
+	buf, err := json.Marshal(jwk)
+	Expect(err).Should(Succeed())
+	return string(buf)
+}
+
+/*
+jwksGet sends a request with a token to the router and returns the
+status code and the error response, if there is one.
+*/
+func jwksGet(h http.Handler, token []byte) (int, *ErrorResponse) {
+	return jwksGetPath(h, "/foobar/xyz/123", token)
+}
+
+func jwksGetPath(h http.Handler, path string, token []byte) (int, *ErrorResponse) {
+	req := httptest.NewRequest("GET", path, nil)
+	req.Header.Set("Authorization", "Bearer "+string(token))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	resp := &ErrorResponse{}
+	if w.Code != http.StatusOK {
+		Expect(json.Unmarshal(w.Body.Bytes(), resp)).Should(Succeed())
+	}
+	return w.Code, resp
+}
@@ -0,0 +1,287 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+/*
+ErrIncorrectPassword is wrapped in the error returned by "Open" when the
+password returned by the function passed to "SetKeyFileWithPassword" does
+not decrypt the key. Use errors.Is to check for it.
+*/
+var ErrIncorrectPassword = errors.New("Incorrect password for TLS key file")
+
+/*
+PasswordFunc returns the password that is used to decrypt the TLS key file.
+*/
+type PasswordFunc func() ([]byte, error)
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA224 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 8}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC     = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+)
+
+/*
+encryptedPrivateKeyInfo is the PKCS#8 "ENCRYPTED PRIVATE KEY" structure.
+*/
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+/*
+SetKeyFileWithPassword is like "SetKeyFile" but for a key file that is
+encrypted. "getPass" will be called to retrieve the password every time
+that the key is loaded, which includes "Open" and any time that the
+certificate is reloaded. Both legacy encrypted PEM files and encrypted
+PKCS#8 files are supported. It is only consulted if "securePort" is >= 0.
+*/
+func (s *HTTPScaffold) SetKeyFileWithPassword(fn string, getPass PasswordFunc) {
+	s.keyFile = fn
+	s.keyPassword = getPass
+}
+
+/*
+loadKeyPair reads the certificate and key files and returns the pair.
+If "getPass" is set and the key is encrypted, then it is decrypted first.
+*/
+func loadKeyPair(certFile, keyFile string, getPass PasswordFunc) (tls.Certificate, error) {
+	if getPass == nil {
+		return tls.LoadX509KeyPair(certFile, keyFile)
+	}
+
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err = decryptKey(keyPEM, getPass)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("Cannot decrypt %s: %w", keyFile, err)
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+/*
+decryptKey returns the key in unencrypted PEM format. Keys that are not
+encrypted are returned as they are.
+*/
+func decryptKey(keyPEM []byte, getPass PasswordFunc) ([]byte, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("No PEM data found in key file")
+	}
+
+	encryptedPKCS8 := block.Type == "ENCRYPTED PRIVATE KEY"
+	if !encryptedPKCS8 && !x509.IsEncryptedPEMBlock(block) {
+		return keyPEM, nil
+	}
+
+	pass, err := getPass()
+	if err != nil {
+		return nil, err
+	}
+
+	if encryptedPKCS8 {
+		der, err := decryptPKCS8(block.Bytes, pass)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	}
+
+	der, err := x509.DecryptPEMBlock(block, pass)
+	if err == x509.IncorrectPasswordError {
+		return nil, ErrIncorrectPassword
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The padding check can pass even if the password is wrong
+	if !validPrivateKey(der) {
+		return nil, ErrIncorrectPassword
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der}), nil
+}
+
+/*
+decryptPKCS8 decrypts a PKCS#8 key that was encrypted using PBES2, which is
+what current versions of OpenSSL produce, and returns the DER-encoded
+private key.
+*/
+func decryptPKCS8(der, pass []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	_, err := asn1.Unmarshal(der, &info)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid encrypted key: %s", err)
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("Unsupported key encryption algorithm %s", info.Algorithm.Algorithm)
+	}
+
+	var params pbes2Params
+	_, err = asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid PBES2 parameters: %s", err)
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("Unsupported key derivation function %s",
+			params.KeyDerivationFunc.Algorithm)
+	}
+	var kdfParams pbkdf2Params
+	_, err = asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdfParams)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid PBKDF2 parameters: %s", err)
+	}
+
+	var prf func() hash.Hash
+	switch {
+	case len(kdfParams.PRF.Algorithm) == 0, kdfParams.PRF.Algorithm.Equal(oidHMACWithSHA1):
+		prf = sha1.New
+	case kdfParams.PRF.Algorithm.Equal(oidHMACWithSHA224):
+		prf = sha256.New224
+	case kdfParams.PRF.Algorithm.Equal(oidHMACWithSHA256):
+		prf = sha256.New
+	case kdfParams.PRF.Algorithm.Equal(oidHMACWithSHA384):
+		prf = sha512.New384
+	case kdfParams.PRF.Algorithm.Equal(oidHMACWithSHA512):
+		prf = sha512.New
+	default:
+		return nil, fmt.Errorf("Unsupported PBKDF2 function %s", kdfParams.PRF.Algorithm)
+	}
+
+	var newCipher func([]byte) (cipher.Block, error)
+	var keyLen int
+	switch {
+	case params.EncryptionScheme.Algorithm.Equal(oidAES128CBC):
+		newCipher, keyLen = aes.NewCipher, 16
+	case params.EncryptionScheme.Algorithm.Equal(oidAES192CBC):
+		newCipher, keyLen = aes.NewCipher, 24
+	case params.EncryptionScheme.Algorithm.Equal(oidAES256CBC):
+		newCipher, keyLen = aes.NewCipher, 32
+	case params.EncryptionScheme.Algorithm.Equal(oidDESEDE3CBC):
+		newCipher, keyLen = des.NewTripleDESCipher, 24
+	default:
+		return nil, fmt.Errorf("Unsupported key encryption cipher %s",
+			params.EncryptionScheme.Algorithm)
+	}
+	if kdfParams.KeyLength > 0 && kdfParams.KeyLength != keyLen {
+		return nil, errors.New("Invalid PBKDF2 key length")
+	}
+
+	var iv []byte
+	_, err = asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cipher parameters: %s", err)
+	}
+
+	key := pbkdf2.Key(pass, kdfParams.Salt, kdfParams.IterationCount, keyLen, prf)
+	block, err := newCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() {
+		return nil, errors.New("Invalid cipher IV")
+	}
+	data := info.EncryptedData
+	if len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, errors.New("Invalid encrypted key length")
+	}
+
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+	out, ok := unpad(out, block.BlockSize())
+	if !ok || !validPrivateKey(out) {
+		return nil, ErrIncorrectPassword
+	}
+	return out, nil
+}
+
+/*
+unpad removes PKCS#7 padding.
+*/
+func unpad(b []byte, blockSize int) ([]byte, bool) {
+	if len(b) == 0 {
+		return nil, false
+	}
+	n := int(b[len(b)-1])
+	if n == 0 || n > blockSize || n > len(b) {
+		return nil, false
+	}
+	if !bytes.Equal(b[len(b)-n:], bytes.Repeat([]byte{byte(n)}, n)) {
+		return nil, false
+	}
+	return b[:len(b)-n], true
+}
+
+/*
+validPrivateKey checks that decrypted data is really a private key, which
+tells us that the password was right.
+*/
+func validPrivateKey(der []byte) bool {
+	if _, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return true
+	}
+	if _, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return true
+	}
+	if _, err := x509.ParseECPrivateKey(der); err == nil {
+		return true
+	}
+	return false
+}
@@ -0,0 +1,301 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+These are the names that "UseInheritedListeners" looks for in
+LISTEN_FDNAMES to decide what each listener is for.
+*/
+const (
+	InsecureListenerName   = "insecure"
+	SecureListenerName     = "secure"
+	ManagementListenerName = "management"
+)
+
+/*
+listenFdsStart is the first file descriptor that is passed using the
+LISTEN_FDS convention.
+*/
+var listenFdsStart = 3
+
+/*
+unixSocket is the path and file mode of a Unix domain socket listener.
+*/
+type unixSocket struct {
+	path string
+	mode os.FileMode
+}
+
+/*
+SetBindAddress sets the addresses that the service listens on. Every port
+listens on all of the addresses. Each one may be an IPv4 address, an IPv6
+address, or a host name. An empty string listens on all the IPv4 and IPv6
+addresses of the host. A host name is resolved when the port is opened and
+the first address is used. If the port is set to zero, then the same
+ephemeral port is used for every address. The default is "0.0.0.0," which
+listens on all IPv4 addresses only, and it is also used if no addresses are
+passed. It must be called before "Open."
+*/
+func (s *HTTPScaffold) SetBindAddress(addrs ...string) {
+	if len(addrs) == 0 {
+		addrs = []string{"0.0.0.0"}
+	}
+	s.bindAddresses = addrs
+}
+
+/*
+SetInsecureUnixSocket causes the service to also listen for regular "HTTP"
+requests on a Unix domain socket at "path." Set the insecure port to -1 to
+listen only on the socket. If "mode" is not zero, then the permissions of
+the socket are changed to it. An old socket at the same path is removed
+if no process is listening on it, and the socket is removed again when
+the service shuts down.
+It must be called before "Open."
+*/
+func (s *HTTPScaffold) SetInsecureUnixSocket(path string, mode os.FileMode) {
+	s.insecureSocket = &unixSocket{path: path, mode: mode}
+}
+
+/*
+SetManagementUnixSocket is like "SetInsecureUnixSocket" but for the
+management operations. If it is set, then the management operations only
+happen on this socket and on the management port, if that is set.
+It must be called before "Open."
+*/
+func (s *HTTPScaffold) SetManagementUnixSocket(path string, mode os.FileMode) {
+	s.mgmtSocket = &unixSocket{path: path, mode: mode}
+}
+
+/*
+SetInsecureListeners causes the service to listen for regular "HTTP"
+requests on listeners that are already open, instead of opening the
+insecure port and Unix domain socket. It must be called before "Open."
+*/
+func (s *HTTPScaffold) SetInsecureListeners(ls ...net.Listener) {
+	s.presetInsecure = ls
+}
+
+/*
+SetSecureListeners is like "SetInsecureListeners" but for HTTPS. The
+listeners must not use TLS, because the scaffold adds TLS using the
+certificates and options that were set up for the secure port.
+It must be called before "Open."
+*/
+func (s *HTTPScaffold) SetSecureListeners(ls ...net.Listener) {
+	s.presetSecure = ls
+}
+
+/*
+SetManagementListeners is like "SetInsecureListeners" but for the
+management operations. It must be called before "Open."
+*/
+func (s *HTTPScaffold) SetManagementListeners(ls ...net.Listener) {
+	s.presetMgmt = ls
+}
+
+/*
+UseInheritedListeners sets up listeners that were passed to the process
+by its parent, such as systemd socket activation, using the LISTEN_FDS
+convention. LISTEN_FDNAMES assigns each one to "InsecureListenerName,"
+"SecureListenerName," or "ManagementListenerName." Listeners with no name
+or the name "unknown" are used for the insecure port. If LISTEN_PID is set
+and is not this process, or LISTEN_FDS is not set, then nothing happens
+and the ports are opened as usual. The environment variables are removed
+so that they are not passed on to other processes. It must be called
+before "Open."
+*/
+func (s *HTTPScaffold) UseInheritedListeners() error {
+	fdsStr := os.Getenv("LISTEN_FDS")
+	pidStr := os.Getenv("LISTEN_PID")
+	namesStr := os.Getenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if fdsStr == "" || (pidStr != "" && pidStr != strconv.Itoa(os.Getpid())) {
+		return nil
+	}
+	n, err := strconv.Atoi(fdsStr)
+	if err != nil || n < 0 {
+		return fmt.Errorf("Invalid LISTEN_FDS %q", fdsStr)
+	}
+	var names []string
+	if namesStr != "" {
+		names = strings.Split(namesStr, ":")
+	}
+
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("Cannot listen on file descriptor %d: %s", fd, err)
+		}
+
+		switch name {
+		case InsecureListenerName, "", "unknown":
+			s.presetInsecure = append(s.presetInsecure, l)
+		case SecureListenerName:
+			s.presetSecure = append(s.presetSecure, l)
+		case ManagementListenerName:
+			s.presetMgmt = append(s.presetMgmt, l)
+		default:
+			l.Close()
+			return fmt.Errorf("Unknown listener name %q", name)
+		}
+	}
+	return nil
+}
+
+/*
+openListeners returns the preset listeners if there are any, and otherwise
+opens the port, if it is >= 0, and the Unix domain socket, if it is set.
+*/
+func (s *HTTPScaffold) openListeners(
+	preset []net.Listener, port int, sock *unixSocket) ([]net.Listener, error) {
+	if len(preset) > 0 {
+		return preset, nil
+	}
+
+	var ls []net.Listener
+	if port >= 0 {
+		var err error
+		ls, err = s.listen(port)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if sock != nil {
+		l, err := listenUnix(sock)
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, err
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+/*
+listen opens a listener on the port for every bind address.
+*/
+func (s *HTTPScaffold) listen(port int) ([]net.Listener, error) {
+	var ls []net.Listener
+	for _, addr := range s.bindAddresses {
+		l, err := net.Listen(bindNetwork(addr), net.JoinHostPort(addr, strconv.Itoa(port)))
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, err
+		}
+		ls = append(ls, l)
+		if port == 0 {
+			// Use the same ephemeral port for the rest of the addresses
+			port = l.Addr().(*net.TCPAddr).Port
+		}
+	}
+	return ls, nil
+}
+
+/*
+listenUnix opens a listener on a Unix domain socket.
+*/
+func listenUnix(sock *unixSocket) (net.Listener, error) {
+	removeStaleSocket(sock.path)
+	return listenUnixMode(sock.path, sock.mode)
+}
+
+/*
+removeStaleSocket removes a socket that was left behind by a process that
+did not shut down cleanly. Anything else at the path, including a socket
+that another process is still serving, is left alone, so that opening the
+new socket fails.
+*/
+func removeStaleSocket(path string) {
+	st, err := os.Lstat(path)
+	if err != nil || st.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	c, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		c.Close()
+		return
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		os.Remove(path)
+	}
+}
+
+/*
+closeListeners closes all the listeners that are open.
+*/
+func (s *HTTPScaffold) closeListeners() {
+	for _, ls := range [][]net.Listener{
+		s.insecureListeners, s.secureListeners, s.mgmtListeners} {
+		for _, l := range ls {
+			l.Close()
+		}
+	}
+}
+
+/*
+bindNetwork returns "tcp4" or "tcp6" for IP addresses so that listening on
+"0.0.0.0" and "::" on the same port works on dual-stack hosts.
+*/
+func bindNetwork(addr string) string {
+	ip := net.ParseIP(addr)
+	switch {
+	case ip == nil:
+		return "tcp"
+	case ip.To4() != nil:
+		return "tcp4"
+	default:
+		return "tcp6"
+	}
+}
+
+func firstAddress(ls []net.Listener) string {
+	if len(ls) == 0 {
+		return ""
+	}
+	return ls[0].Addr().String()
+}
+
+func listenerAddresses(ls []net.Listener) []string {
+	addrs := make([]string, len(ls))
+	for i, l := range ls {
+		addrs[i] = l.Addr().String()
+	}
+	return addrs
+}
@@ -0,0 +1,300 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Listener tests", func() {
+	It("Bind network", func() {
+		Expect(bindNetwork("127.0.0.1")).Should(Equal("tcp4"))
+		Expect(bindNetwork("0.0.0.0")).Should(Equal("tcp4"))
+		Expect(bindNetwork("::1")).Should(Equal("tcp6"))
+		Expect(bindNetwork("::")).Should(Equal("tcp6"))
+		Expect(bindNetwork("localhost")).Should(Equal("tcp"))
+		Expect(bindNetwork("")).Should(Equal("tcp"))
+	})
+
+	It("Dual stack", func() {
+		s := CreateHTTPScaffold()
+		s.SetBindAddress("127.0.0.1", "::1")
+		s.SetInsecurePort(0)
+		s.SetManagementPort(0)
+		s.SetHealthPath("/health")
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		stopChan := make(chan error)
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		addrs := s.InsecureAddresses()
+		Expect(addrs).Should(HaveLen(2))
+		Expect(s.InsecureAddress()).Should(Equal(addrs[0]))
+		_, port4, _ := net.SplitHostPort(addrs[0])
+		Expect(addrs[0]).Should(Equal("127.0.0.1:" + port4))
+		Expect(addrs[1]).Should(Equal("[::1]:" + port4))
+		Expect(s.SecureAddresses()).Should(BeEmpty())
+		Expect(s.ManagementAddresses()).Should(HaveLen(2))
+
+		for _, addr := range addrs {
+			Eventually(func() int {
+				code, _ := getText(fmt.Sprintf("http://%s", addr))
+				return code
+			}, 5*time.Second).Should(Equal(200))
+		}
+		for _, addr := range s.ManagementAddresses() {
+			code, _ := getText(fmt.Sprintf("http://%s/health", addr))
+			Expect(code).Should(Equal(200))
+		}
+
+		shutdownErr := errors.New("Validate")
+		s.Shutdown(shutdownErr)
+		Eventually(stopChan).Should(Receive(Equal(shutdownErr)))
+	})
+
+	It("Bind host name", func() {
+		s := CreateHTTPScaffold()
+		s.SetBindAddress("localhost")
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		stopChan := make(chan error)
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(func() bool {
+			return testGet(s, "")
+		}, 5*time.Second).Should(BeTrue())
+
+		shutdownErr := errors.New("Validate")
+		s.Shutdown(shutdownErr)
+		Eventually(stopChan).Should(Receive(Equal(shutdownErr)))
+	})
+
+	It("Bind IPv4 address", func() {
+		s := CreateHTTPScaffold()
+		s.SetlocalBindIPAddressV4(net.ParseIP("127.0.0.1"))
+		Expect(s.bindAddresses).Should(Equal([]string{"127.0.0.1"}))
+
+		// Nil means all addresses, like before
+		s.SetlocalBindIPAddressV4(nil)
+		Expect(s.bindAddresses).Should(Equal([]string{"0.0.0.0"}))
+		err := s.Open()
+		Expect(err).Should(Succeed())
+		Expect(s.InsecureAddress()).Should(HavePrefix("0.0.0.0:"))
+		s.closeListeners()
+
+		// So does an empty list
+		s = CreateHTTPScaffold()
+		s.SetBindAddress()
+		Expect(s.bindAddresses).Should(Equal([]string{"0.0.0.0"}))
+		err = s.Open()
+		Expect(err).Should(Succeed())
+		Expect(s.InsecureAddress()).Should(HavePrefix("0.0.0.0:"))
+		s.closeListeners()
+	})
+
+	It("Bind failure", func() {
+		l, err := net.Listen("tcp4", "127.0.0.1:0")
+		Expect(err).Should(Succeed())
+		defer l.Close()
+		port := l.Addr().(*net.TCPAddr).Port
+
+		// The first address works, but the second is in use
+		s := CreateHTTPScaffold()
+		s.SetBindAddress("::1", "127.0.0.1")
+		s.SetInsecurePort(port)
+		err = s.Open()
+		Expect(err).ShouldNot(Succeed())
+
+		// The first listener was closed
+		l6, err := net.Listen("tcp6", fmt.Sprintf("[::1]:%d", port))
+		Expect(err).Should(Succeed())
+		l6.Close()
+	})
+
+	It("Unix sockets", func() {
+		tmpDir, err := ioutil.TempDir("", "goscaffold")
+		Expect(err).Should(Succeed())
+		defer os.RemoveAll(tmpDir)
+		sockPath := filepath.Join(tmpDir, "http.sock")
+		mgmtPath := filepath.Join(tmpDir, "mgmt.sock")
+
+		// Left over from an earlier run
+		old, err := net.ListenUnix("unix", &net.UnixAddr{Name: sockPath, Net: "unix"})
+		Expect(err).Should(Succeed())
+		old.SetUnlinkOnClose(false)
+		old.Close()
+
+		s := CreateHTTPScaffold()
+		s.SetInsecurePort(-1)
+		s.SetInsecureUnixSocket(sockPath, 0660)
+		s.SetManagementUnixSocket(mgmtPath, 0)
+		s.SetHealthPath("/health")
+		err = s.Open()
+		Expect(err).Should(Succeed())
+		Expect(s.InsecureAddress()).Should(Equal(sockPath))
+		Expect(s.ManagementAddresses()).Should(Equal([]string{mgmtPath}))
+
+		st, err := os.Stat(sockPath)
+		Expect(err).Should(Succeed())
+		Expect(st.Mode() & os.ModePerm).Should(Equal(os.FileMode(0660)))
+		// Nothing is left behind from creating the socket
+		files, err := ioutil.ReadDir(tmpDir)
+		Expect(err).Should(Succeed())
+		Expect(files).Should(HaveLen(2))
+
+		stopChan := make(chan error)
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		client := unixClient(sockPath)
+		mgmtClient := unixClient(mgmtPath)
+
+		Eventually(func() int {
+			resp, err := client.Get("http://localhost/")
+			if err != nil {
+				return 0
+			}
+			resp.Body.Close()
+			return resp.StatusCode
+		}, 5*time.Second).Should(Equal(200))
+
+		// The management socket does not serve the API
+		resp, err := mgmtClient.Get("http://localhost/")
+		Expect(err).Should(Succeed())
+		resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(404))
+		resp, err = mgmtClient.Get("http://localhost/health")
+		Expect(err).Should(Succeed())
+		resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(200))
+
+		shutdownErr := errors.New("Validate")
+		s.Shutdown(shutdownErr)
+		Eventually(stopChan).Should(Receive(Equal(shutdownErr)))
+
+		_, err = os.Stat(sockPath)
+		Expect(os.IsNotExist(err)).Should(BeTrue())
+		_, err = os.Stat(mgmtPath)
+		Expect(os.IsNotExist(err)).Should(BeTrue())
+	})
+
+	It("Unix socket in use", func() {
+		tmpDir, err := ioutil.TempDir("", "goscaffold")
+		Expect(err).Should(Succeed())
+		defer os.RemoveAll(tmpDir)
+		sockPath := filepath.Join(tmpDir, "http.sock")
+		filePath := filepath.Join(tmpDir, "file")
+
+		// Another process is still serving on the socket
+		live, err := net.Listen("unix", sockPath)
+		Expect(err).Should(Succeed())
+		defer live.Close()
+		s := CreateHTTPScaffold()
+		s.SetInsecurePort(-1)
+		s.SetInsecureUnixSocket(sockPath, 0)
+		Expect(s.Open()).ShouldNot(Succeed())
+		s = CreateHTTPScaffold()
+		s.SetInsecurePort(-1)
+		s.SetInsecureUnixSocket(sockPath, 0600)
+		Expect(s.Open()).ShouldNot(Succeed())
+		c, err := net.Dial("unix", sockPath)
+		Expect(err).Should(Succeed())
+		c.Close()
+
+		// Not a socket
+		err = ioutil.WriteFile(filePath, []byte("Hello"), 0600)
+		Expect(err).Should(Succeed())
+		s = CreateHTTPScaffold()
+		s.SetInsecurePort(-1)
+		s.SetInsecureUnixSocket(filePath, 0600)
+		Expect(s.Open()).ShouldNot(Succeed())
+		buf, err := ioutil.ReadFile(filePath)
+		Expect(err).Should(Succeed())
+		Expect(string(buf)).Should(Equal("Hello"))
+		files, err := ioutil.ReadDir(tmpDir)
+		Expect(err).Should(Succeed())
+		Expect(files).Should(HaveLen(2))
+	})
+
+	It("Preset listeners", func() {
+		il, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).Should(Succeed())
+		sl, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).Should(Succeed())
+		ml, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).Should(Succeed())
+
+		s := CreateHTTPScaffold()
+		s.SetInsecurePort(0)
+		s.SetInsecureListeners(il)
+		s.SetSecureListeners(sl)
+		s.SetManagementListeners(ml)
+		s.SetKeyFile("./testkeys/clearkey.pem")
+		s.SetCertFile("./testkeys/clearcert.pem")
+		s.SetHealthPath("/health")
+		err = s.Open()
+		Expect(err).Should(Succeed())
+		Expect(s.InsecureAddresses()).Should(Equal([]string{il.Addr().String()}))
+		Expect(s.SecureAddress()).Should(Equal(sl.Addr().String()))
+		Expect(s.ManagementAddress()).Should(Equal(ml.Addr().String()))
+
+		stopChan := make(chan error)
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(func() bool {
+			return testGet(s, "")
+		}, 5*time.Second).Should(BeTrue())
+		Expect(testGetSecure(s, "")).Should(BeTrue())
+		code, _ := getText(fmt.Sprintf("http://%s/health", s.ManagementAddress()))
+		Expect(code).Should(Equal(200))
+
+		shutdownErr := errors.New("Validate")
+		s.Shutdown(shutdownErr)
+		Eventually(stopChan).Should(Receive(Equal(shutdownErr)))
+	})
+})
+
+/*
+unixClient returns a client that sends every request to a Unix socket.
+*/
+func unixClient(path string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		},
+	}
+}
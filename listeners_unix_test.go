@@ -0,0 +1,125 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package goscaffold
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Inherited listener tests", func() {
+	It("Inherited listeners", func() {
+		defer func() {
+			listenFdsStart = 3
+		}()
+
+		il, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).Should(Succeed())
+		ml, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).Should(Succeed())
+
+		s := CreateHTTPScaffold()
+		s.SetInsecurePort(-1)
+		s.SetHealthPath("/health")
+
+		// Nothing to inherit
+		Expect(s.UseInheritedListeners()).Should(Succeed())
+
+		// Meant for another process
+		os.Setenv("LISTEN_FDS", "1")
+		os.Setenv("LISTEN_PID", "1")
+		Expect(s.UseInheritedListeners()).Should(Succeed())
+		Expect(os.Getenv("LISTEN_FDS")).Should(BeEmpty())
+
+		// Pass one at a time because the descriptors are not consecutive
+		for _, l := range []struct {
+			listener net.Listener
+			name     string
+		}{
+			{il, ""},
+			{ml, ManagementListenerName},
+		} {
+			listenFdsStart = passListener(l.listener)
+			os.Setenv("LISTEN_FDS", "1")
+			os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+			os.Setenv("LISTEN_FDNAMES", l.name)
+			Expect(s.UseInheritedListeners()).Should(Succeed())
+		}
+		Expect(os.Getenv("LISTEN_FDS")).Should(BeEmpty())
+		Expect(os.Getenv("LISTEN_PID")).Should(BeEmpty())
+		Expect(os.Getenv("LISTEN_FDNAMES")).Should(BeEmpty())
+
+		err = s.Open()
+		Expect(err).Should(Succeed())
+		Expect(s.InsecureAddress()).Should(Equal(il.Addr().String()))
+		Expect(s.ManagementAddress()).Should(Equal(ml.Addr().String()))
+
+		stopChan := make(chan error)
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(func() bool {
+			return testGet(s, "")
+		}, 5*time.Second).Should(BeTrue())
+		code, _ := getText(fmt.Sprintf("http://%s/health", s.ManagementAddress()))
+		Expect(code).Should(Equal(200))
+
+		shutdownErr := errors.New("Validate")
+		s.Shutdown(shutdownErr)
+		Eventually(stopChan).Should(Receive(Equal(shutdownErr)))
+	})
+
+	It("Inherited listener errors", func() {
+		s := CreateHTTPScaffold()
+		os.Setenv("LISTEN_FDS", "foo")
+		Expect(s.UseInheritedListeners()).Should(MatchError(`Invalid LISTEN_FDS "foo"`))
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).Should(Succeed())
+		listenFdsStart = passListener(l)
+		defer func() {
+			listenFdsStart = 3
+		}()
+		os.Setenv("LISTEN_FDS", "1")
+		os.Setenv("LISTEN_FDNAMES", "other")
+		Expect(s.UseInheritedListeners()).Should(MatchError(`Unknown listener name "other"`))
+	})
+})
+
+/*
+passListener closes the listener and returns a copy of its file descriptor,
+which is owned by whoever uses it next, like an inherited one.
+*/
+func passListener(l net.Listener) int {
+	f, err := l.(*net.TCPListener).File()
+	Expect(err).Should(Succeed())
+	fd, err := syscall.Dup(int(f.Fd()))
+	Expect(err).Should(Succeed())
+	f.Close()
+	l.Close()
+	return fd
+}
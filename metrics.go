@@ -0,0 +1,219 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+/*
+durationBuckets are the upper bounds, in seconds, of the buckets in the
+request duration histogram. They are the same as the Prometheus defaults.
+*/
+var durationBuckets = []float64{
+	0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+/*
+allStatuses is every HealthStatus, in the order that we report them.
+*/
+var allStatuses = []HealthStatus{OK, NotReady, Failed, Starting}
+
+/*
+requestMetrics counts the API calls that pass through the scaffold.
+*/
+type requestMetrics struct {
+	lock    sync.Mutex
+	codes   map[int]uint64
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func newRequestMetrics() *requestMetrics {
+	return &requestMetrics{
+		codes:   make(map[int]uint64),
+		buckets: make([]uint64, len(durationBuckets)),
+	}
+}
+
+/*
+record adds a completed request to the metrics.
+*/
+func (m *requestMetrics) record(code int, d time.Duration) {
+	secs := d.Seconds()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.codes[code]++
+	m.count++
+	m.sum += secs
+	for i, b := range durationBuckets {
+		if secs <= b {
+			m.buckets[i]++
+			break
+		}
+	}
+}
+
+/*
+write writes the request metrics in the Prometheus text format.
+*/
+func (m *requestMetrics) write(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var codes []int
+	for c := range m.codes {
+		codes = append(codes, c)
+	}
+	sort.Ints(codes)
+
+	writeMetricHeader(w, "goscaffold_http_requests_total", "counter",
+		"Number of HTTP requests handled, by status code.")
+	for _, c := range codes {
+		fmt.Fprintf(w, "goscaffold_http_requests_total{code=\"%d\"} %d\n", c, m.codes[c])
+	}
+
+	writeMetricHeader(w, "goscaffold_http_request_duration_seconds", "histogram",
+		"Time taken to handle HTTP requests.")
+	var cumulative uint64
+	for i, b := range durationBuckets {
+		cumulative += m.buckets[i]
+		fmt.Fprintf(w, "goscaffold_http_request_duration_seconds_bucket{le=\"%s\"} %d\n",
+			formatFloat(b), cumulative)
+	}
+	fmt.Fprintf(w, "goscaffold_http_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.count)
+	fmt.Fprintf(w, "goscaffold_http_request_duration_seconds_sum %s\n", formatFloat(m.sum))
+	fmt.Fprintf(w, "goscaffold_http_request_duration_seconds_count %d\n", m.count)
+}
+
+/*
+SetMetricsPath sets up a path on the management port (if set) or otherwise
+the main port that returns metrics in the Prometheus text format. The
+metrics include the number of requests by status code, a histogram of
+request durations, the number of requests in progress, whether the server
+is marked down, and when the TLS certificates expire. If the health checks
+run in the background (see "SetHealthCheckInterval") then the metrics also
+include the results of the last run. Otherwise they are left out, so that
+scrapes do not run the checks.
+*/
+func (s *HTTPScaffold) SetMetricsPath(p string) {
+	s.metricsPath = p
+}
+
+/*
+handleMetrics returns all the metrics.
+*/
+func (s *HTTPScaffold) handleMetrics(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	s.metrics.write(buf)
+
+	writeMetricHeader(buf, "goscaffold_http_requests_in_flight", "gauge",
+		"Number of HTTP requests in progress.")
+	fmt.Fprintf(buf, "goscaffold_http_requests_in_flight %d\n", s.tracker.activeRequests())
+
+	writeMetricHeader(buf, "goscaffold_marked_down", "gauge",
+		"Whether the server is marked down or shutting down.")
+	fmt.Fprintf(buf, "goscaffold_marked_down %d\n", boolToInt(s.tracker.markedDown() != nil))
+
+	// Only report health from the background checks, because running
+	// every check on every scrape could be expensive.
+	if s.healthInterval > 0 {
+		writeHealthMetrics(buf, s.healthCache.get(s.healthDeadline))
+	}
+
+	var certs []certificateInfo
+	if s.certLoader != nil {
+		certs = s.certLoader.certificates()
+	}
+	if len(certs) > 0 {
+		writeMetricHeader(buf, "goscaffold_tls_certificate_expiry_timestamp_seconds", "gauge",
+			"Time when each TLS certificate chain expires, in seconds since the epoch.")
+		for _, c := range certs {
+			fmt.Fprintf(buf, "goscaffold_tls_certificate_expiry_timestamp_seconds{cert_file=\"%s\"} %d\n",
+				escapeLabel(c.CertFile), c.Expires.Unix())
+		}
+	}
+
+	resp.Header().Set("Content-Type", metricsContentType)
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(buf.Bytes())
+}
+
+/*
+writeHealthMetrics writes the overall status and the result of each named
+check from a health report.
+*/
+func writeHealthMetrics(buf io.Writer, report *healthReport) {
+	writeMetricHeader(buf, "goscaffold_health_status", "gauge",
+		"Overall result of the health checks.")
+	for _, st := range allStatuses {
+		fmt.Fprintf(buf, "goscaffold_health_status{status=\"%s\"} %d\n",
+			st, boolToInt(report.status == st))
+	}
+
+	if len(report.Checks) > 0 {
+		writeMetricHeader(buf, "goscaffold_health_check_ok", "gauge",
+			"Whether each named health check succeeded.")
+		for _, c := range report.Checks {
+			fmt.Fprintf(buf, "goscaffold_health_check_ok{check=\"%s\"} %d\n",
+				escapeLabel(c.Name), boolToInt(c.status == OK))
+		}
+		writeMetricHeader(buf, "goscaffold_health_check_latency_seconds", "gauge",
+			"Time taken by each named health check.")
+		for _, c := range report.Checks {
+			fmt.Fprintf(buf, "goscaffold_health_check_latency_seconds{check=\"%s\"} %s\n",
+				escapeLabel(c.Name), formatFloat(c.latency.Seconds()))
+		}
+	}
+}
+
+func writeMetricHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+var labelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
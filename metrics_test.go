@@ -0,0 +1,51 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"bytes"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Metrics tests", func() {
+	It("Request metrics", func() {
+		m := newRequestMetrics()
+		m.record(200, 3*time.Millisecond)
+		m.record(200, 200*time.Millisecond)
+		m.record(503, time.Minute)
+
+		buf := &bytes.Buffer{}
+		m.write(buf)
+		out := buf.String()
+		Expect(out).Should(ContainSubstring("# TYPE goscaffold_http_requests_total counter\n"))
+		Expect(out).Should(ContainSubstring("goscaffold_http_requests_total{code=\"200\"} 2\n"))
+		Expect(out).Should(ContainSubstring("goscaffold_http_requests_total{code=\"503\"} 1\n"))
+		Expect(out).Should(ContainSubstring("# TYPE goscaffold_http_request_duration_seconds histogram\n"))
+		Expect(out).Should(ContainSubstring("goscaffold_http_request_duration_seconds_bucket{le=\"0.005\"} 1\n"))
+		Expect(out).Should(ContainSubstring("goscaffold_http_request_duration_seconds_bucket{le=\"0.1\"} 1\n"))
+		Expect(out).Should(ContainSubstring("goscaffold_http_request_duration_seconds_bucket{le=\"0.25\"} 2\n"))
+		Expect(out).Should(ContainSubstring("goscaffold_http_request_duration_seconds_bucket{le=\"10\"} 2\n"))
+		Expect(out).Should(ContainSubstring("goscaffold_http_request_duration_seconds_bucket{le=\"+Inf\"} 3\n"))
+		Expect(out).Should(ContainSubstring("goscaffold_http_request_duration_seconds_count 3\n"))
+	})
+
+	It("Escape labels", func() {
+		Expect(escapeLabel("plain")).Should(Equal("plain"))
+		Expect(escapeLabel("a\"b\\c\nd")).Should(Equal("a\\\"b\\\\c\\nd"))
+	})
+})
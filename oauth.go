@@ -16,23 +16,38 @@ package goscaffold
 
 import (
 	"context"
-	"crypto/rsa"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/SermoDigital/jose/crypto"
 	"github.com/SermoDigital/jose/jws"
+	"github.com/SermoDigital/jose/jwt"
 	"github.com/julienschmidt/httprouter"
 	"github.com/justinas/alice"
 )
 
 const params = "params"
 
+/*
+DefaultKeyRefetchInterval is the least amount of time between fetches of
+the public keys when a token has a key ID that we do not know.
+*/
+const DefaultKeyRefetchInterval = time.Minute
+
 // Errors to return
 type Errors []string
 
+/*
+Error joins the errors into one string.
+*/
+func (e Errors) Error() string {
+	return strings.Join(e, "; ")
+}
+
 /*
 The SSO key parameters
 */
@@ -47,11 +62,19 @@ type ssoKey struct {
 
 /*
 oauth provides http an connection to the URL that has the public
-key for verifying the JWT token
+keys for verifying the JWT token
 */
 type oauth struct {
-	gPkey   *rsa.PublicKey
-	rwMutex *sync.RWMutex
+	keyURL          string
+	keys            publicKeys
+	algorithms      map[string]bool
+	options         OAuthOptions
+	rwMutex         *sync.RWMutex
+	fetchLock       sync.Mutex
+	lastFetch       time.Time
+	fetchCount      int
+	storedFetch     int
+	refetchInterval time.Duration
 }
 
 /*
@@ -59,9 +82,10 @@ ErrorResponse delivers the errors back to the caller, once validation
 has failed
 */
 type ErrorResponse struct {
-	Status  string   `json:"status"`
-	Message string   `json:"message"`
-	Errors  []string `json:"errors"`
+	Status    string   `json:"status"`
+	Message   string   `json:"message"`
+	Errors    []string `json:"errors"`
+	RequestID string   `json:"requestId,omitempty"`
 }
 
 /*
@@ -73,19 +97,61 @@ type OAuthService interface {
 	SSOHandler(p string, h func(http.ResponseWriter, *http.Request)) (string, httprouter.Handle)
 }
 
+/*
+AuthorizingOAuthService is an OAuthService that can also require that a
+token grants scopes, or that its claims pass a check, before the handler
+is called. It is returned by "CreateOAuthWithOptions," and the value
+returned by "CreateOAuth" implements it too.
+*/
+type AuthorizingOAuthService interface {
+	OAuthService
+	SSOHandlerWithScopes(p string, scopes []string, h func(http.ResponseWriter, *http.Request)) (string, httprouter.Handle)
+	SSOHandlerWithPredicate(p string, allow func(jwt.Claims) bool, h func(http.ResponseWriter, *http.Request)) (string, httprouter.Handle)
+}
+
 /*
 CreateOAuth is a constructor that creates OAuth for OAuthService
 interface. OAuthService interface offers method:-
 (1) SSOHandler(): Offers the user to attach http handler for JWT
 verification.
+The key URL may return a standard JWKS document with a list of keys, in
+which case the key is chosen using the "kid" header of each token, or a
+single key in PEM format in the "value" field. The keys are fetched again
+every hour, and also when a token has a key ID that we do not know, but
+no more often than DefaultKeyRefetchInterval.
 */
 func (s *HTTPScaffold) CreateOAuth(keyURL string) OAuthService {
-	pk, _ := getPublicKey(keyURL)
+	return s.createOAuth(keyURL, OAuthOptions{}, nil)
+}
+
+/*
+CreateOAuthWithOptions is like CreateOAuth, but also checks the issuer,
+audience, signature algorithm, and other claims of each token as described
+by "opts." When a token fails any of the claim checks, each failure is
+listed in the "Errors" of the response. An error is returned if the
+"Algorithms" option is not valid. The result also offers:-
+(1) SSOHandlerWithScopes(): Like SSOHandler, but also requires scopes.
+(2) SSOHandlerWithPredicate(): Like SSOHandler, but also requires that
+the claims of the token pass a check.
+*/
+func (s *HTTPScaffold) CreateOAuthWithOptions(keyURL string, opts OAuthOptions) (AuthorizingOAuthService, error) {
+	algorithms, err := allowedAlgorithms(opts.Algorithms)
+	if err != nil {
+		return nil, err
+	}
+	return s.createOAuth(keyURL, opts, algorithms), nil
+}
+
+func (s *HTTPScaffold) createOAuth(keyURL string, opts OAuthOptions, algorithms map[string]bool) *oauth {
 	oa := &oauth{
-		rwMutex: &sync.RWMutex{},
+		keyURL:          keyURL,
+		rwMutex:         &sync.RWMutex{},
+		refetchInterval: DefaultKeyRefetchInterval,
+		options:         opts,
+		algorithms:      algorithms,
 	}
-	oa.setPkSafe(pk)
-	oa.updatePublicKeysPeriodic(keyURL)
+	oa.refetchKeys(0)
+	oa.updatePublicKeysPeriodic()
 	return oa
 }
 
@@ -105,6 +171,15 @@ func FetchParams(r *http.Request) httprouter.Params {
 	return ctx.Value(params).(httprouter.Params)
 }
 
+/*
+FetchClaims returns the claims from the token that VerifyOAuth verified
+for the request, or nil if there was none.
+*/
+func FetchClaims(r *http.Request) jwt.Claims {
+	claims, _ := r.Context().Value(claimsKey).(jwt.Claims)
+	return claims
+}
+
 /*
 SSOHandler offers the users the flexibility of choosing which http handlers
 need JWT validation.
@@ -113,6 +188,51 @@ func (a *oauth) SSOHandler(p string, h func(http.ResponseWriter, *http.Request))
 	return p, a.VerifyOAuth(alice.New().ThenFunc(h))
 }
 
+/*
+SSOHandlerWithScopes is like SSOHandler, but the token must also have been
+granted all of the scopes in its "scope" or "scp" claim. Otherwise a 403
+error is returned.
+*/
+func (a *oauth) SSOHandlerWithScopes(
+	p string, scopes []string, h func(http.ResponseWriter, *http.Request)) (string, httprouter.Handle) {
+	return p, a.VerifyOAuth(authorizeHandler(func(claims jwt.Claims) string {
+		missing := missingScopes(claims, scopes)
+		if len(missing) > 0 {
+			return "Token is missing required scopes: " + strings.Join(missing, " ")
+		}
+		return ""
+	}, h))
+}
+
+/*
+SSOHandlerWithPredicate is like SSOHandler, but "allow" must also return
+true for the claims of the token. Otherwise a 403 error is returned.
+*/
+func (a *oauth) SSOHandlerWithPredicate(
+	p string, allow func(jwt.Claims) bool, h func(http.ResponseWriter, *http.Request)) (string, httprouter.Handle) {
+	return p, a.VerifyOAuth(authorizeHandler(func(claims jwt.Claims) string {
+		if !allow(claims) {
+			return "Token is not authorized for this request"
+		}
+		return ""
+	}, h))
+}
+
+/*
+authorizeHandler calls "check" with the verified claims and returns a 403
+error with the message if it returns one. Otherwise it calls "h."
+*/
+func authorizeHandler(
+	check func(jwt.Claims) string, h func(http.ResponseWriter, *http.Request)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if msg := check(FetchClaims(r)); msg != "" {
+			WriteRequestErrorResponse(http.StatusForbidden, msg, r, w)
+			return
+		}
+		h(w, r)
+	})
+}
+
 /*
 VerifyOAuth verifies the JWT token in the request using the public key configured
 via CreateOAuth constructor.
@@ -122,27 +242,61 @@ func (a *oauth) VerifyOAuth(next http.Handler) httprouter.Handle {
 	return func(rw http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 
 		/* Parse the JWT from the input request */
-		jwt, err := jws.ParseJWTFromRequest(r)
+		token, err := jws.ParseJWTFromRequest(r)
 		if err != nil {
-			WriteErrorResponse(http.StatusBadRequest, err.Error(), rw)
+			WriteRequestErrorResponse(http.StatusBadRequest, err.Error(), r, rw)
 			return
 		}
 
-		/* Get the pulic key from cache */
-		pk := a.getPkSafe()
-		if pk == nil {
-			WriteErrorResponse(http.StatusBadRequest, "Public key not configured. Validation failed.", rw)
+		/* Check the signature algorithm before trusting anything else */
+		alg := tokenHeader(token, "alg")
+		if !a.algorithmAllowed(alg) {
+			WriteRequestErrorResponse(http.StatusBadRequest,
+				fmt.Sprintf("Signature algorithm %q is not allowed. Validation failed.", alg), r, rw)
 			return
 		}
 
-		/* Validate the token */
-		err = jwt.Validate(pk, crypto.SigningMethodRS256)
+		/* Get the public key from cache */
+		pk, err := a.findKey(tokenHeader(token, "kid"))
 		if err != nil {
-			WriteErrorResponse(http.StatusBadRequest, err.Error(), rw)
+			WriteRequestErrorResponse(http.StatusBadRequest, err.Error(), r, rw)
+			return
+		}
+		if pk.alg != "" && pk.alg != alg {
+			WriteRequestErrorResponse(http.StatusBadRequest,
+				fmt.Sprintf("Key is for algorithm %q, not %q. Validation failed.", pk.alg, alg), r, rw)
 			return
 		}
 
-		/* Set the input params in the request */
+		/* Validate the token and its claims */
+		err = token.Validate(pk.key, jws.GetSigningMethod(alg), &jwt.Validator{
+			EXP: a.options.ClockSkew,
+			NBF: a.options.ClockSkew,
+			Fn:  a.options.checkClaims,
+		})
+		switch err {
+		case jwt.ErrTokenIsExpired:
+			err = Errors{"Token is expired"}
+		case jwt.ErrTokenNotYetValid:
+			err = Errors{"Token is not valid yet"}
+		}
+		if errs, ok := err.(Errors); ok {
+			writeErrorResponse(http.StatusBadRequest,
+				"Token claims are not valid. Validation failed.", errs, FetchRequestID(r), rw)
+			return
+		}
+		if err != nil {
+			WriteRequestErrorResponse(http.StatusBadRequest, err.Error(), r, rw)
+			return
+		}
+
+		/* Record who made the call in the access log */
+		if sub, ok := token.Claims().Subject(); ok {
+			setAccessLogUser(r, sub)
+		}
+
+		/* Set the verified claims and the input params in the request */
+		r = r.WithContext(context.WithValue(r.Context(), claimsKey, token.Claims()))
 		r = SetParamsInRequest(r, ps)
 		next.ServeHTTP(rw, r)
 	}
@@ -150,18 +304,58 @@ func (a *oauth) VerifyOAuth(next http.Handler) httprouter.Handle {
 }
 
 /*
-WriteErrorResponse write a non 200 error response
+WriteErrorResponse write a non 200 error response. If "w" is the writer
+that the scaffold passed to the handler, or wraps it and has an "Unwrap"
+method, then the response includes the request ID.
 */
 func WriteErrorResponse(statusCode int, message string, w http.ResponseWriter) {
+	writeErrorResponse(statusCode, message, nil, writerRequestID(w), w)
+}
+
+/*
+WriteRequestErrorResponse is like WriteErrorResponse, but it takes the
+request ID from the context of "r," so that the ID is included no matter
+how "w" was wrapped by other handlers.
+*/
+func WriteRequestErrorResponse(
+	statusCode int, message string, r *http.Request, w http.ResponseWriter) {
+	writeErrorResponse(statusCode, message, nil, FetchRequestID(r), w)
+}
+
+/*
+writerRequestID looks for the request ID in the writer that the scaffold
+passed to the handler.
+*/
+func writerRequestID(w http.ResponseWriter) string {
+	for {
+		if rr, ok := w.(*responseRecorder); ok {
+			return rr.requestID
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return ""
+		}
+		w = u.Unwrap()
+	}
+}
+
+/*
+writeErrorResponse is like WriteErrorResponse, and adds more detailed
+errors after the status text.
+*/
+func writeErrorResponse(
+	statusCode int, message string, errs Errors, requestID string, w http.ResponseWriter) {
 	var errstr []string
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
 	errstr = append(errstr, http.StatusText(statusCode))
+	errstr = append(errstr, errs...)
 	resp := ErrorResponse{
-		Status:  http.StatusText(statusCode),
-		Message: message,
-		Errors:  errstr,
+		Status:    http.StatusText(statusCode),
+		Message:   message,
+		Errors:    errstr,
+		RequestID: requestID,
 	}
 	json.NewEncoder(w).Encode(resp)
 }
@@ -169,7 +363,7 @@ func WriteErrorResponse(statusCode int, message string, w http.ResponseWriter) {
 /*
 updatePulicKeysPeriodic updates the cache periodically (every hour)
 */
-func (a *oauth) updatePublicKeysPeriodic(keyURL string) {
+func (a *oauth) updatePublicKeysPeriodic() {
 
 	ticker := time.NewTicker(time.Hour)
 	quit := make(chan struct{})
@@ -177,10 +371,7 @@ func (a *oauth) updatePublicKeysPeriodic(keyURL string) {
 		for {
 			select {
 			case <-ticker.C:
-				pk, err := getPublicKey(keyURL)
-				if err == nil {
-					a.setPkSafe(pk)
-				}
+				a.refetchKeys(0)
 			case <-quit:
 				ticker.Stop()
 				return
@@ -190,49 +381,93 @@ func (a *oauth) updatePublicKeysPeriodic(keyURL string) {
 }
 
 /*
-getPubicKey: Loads the Public key in to memory and returns it.
+findKey returns the public key for a key ID from the cache. If the key ID
+is not there, then the keys are fetched again, unless that was done less
+than "refetchInterval" ago. A key in the older single key format is used
+for every key ID without fetching the keys again.
 */
-func getPublicKey(keyURL string) (*rsa.PublicKey, error) {
+func (a *oauth) findKey(kid string) (*publicKey, error) {
+	keys := a.getKeysSafe()
+	if pk := keys[kid]; pk != nil {
+		return pk, nil
+	}
 
-	/* Connect to the server to fetch Key details */
-	r, err := http.Get(keyURL)
-	if err != nil {
-		return nil, err
+	// Look for a new key, unless we have a single key that is used for all
+	// key IDs, which is refreshed in the background
+	if a.keyURL != "" && keys.legacyKey() == nil {
+		a.refetchKeys(a.refetchInterval)
+		keys = a.getKeysSafe()
+	}
+	if pk := keys.find(kid); pk != nil {
+		return pk, nil
 	}
 
-	defer r.Body.Close()
+	if len(keys) == 0 {
+		return nil, errors.New("Public key not configured. Validation failed.")
+	}
+	if kid == "" {
+		return nil, errors.New("Token has no key ID. Validation failed.")
+	}
+	return nil, fmt.Errorf("No public key for key ID %q. Validation failed.", kid)
+}
 
-	/* Decode the SSO Key */
-	ssoKey := &ssoKey{}
-	err = json.NewDecoder(r.Body).Decode(ssoKey)
-	if err != nil {
-		return nil, err
+/*
+refetchKeys loads the public keys from the key URL and replaces the cache,
+unless they were loaded less than "minInterval" ago. If that fails, then
+the old keys are kept. The lock is not held while the keys are fetched.
+*/
+func (a *oauth) refetchKeys(minInterval time.Duration) {
+	a.fetchLock.Lock()
+	if time.Since(a.lastFetch) < minInterval {
+		a.fetchLock.Unlock()
+		return
 	}
+	a.lastFetch = time.Now()
+	a.fetchCount++
+	fetch := a.fetchCount
+	a.fetchLock.Unlock()
 
-	/* Retrieve the Public Key from SSO Key */
-	publicKey, err := crypto.ParseRSAPublicKeyFromPEM([]byte(ssoKey.Value))
+	keys, err := fetchPublicKeys(a.keyURL)
 	if err != nil {
-		return nil, err
+		return
+	}
+
+	// Do not replace the keys from a fetch that started later
+	a.fetchLock.Lock()
+	defer a.fetchLock.Unlock()
+	if fetch > a.storedFetch {
+		a.storedFetch = fetch
+		a.setKeysSafe(keys)
 	}
-	return publicKey, nil
+}
 
+/*
+tokenHeader returns a header of the token, such as "kid," if it has one.
+*/
+func tokenHeader(token jwt.JWT, name string) string {
+	if j, ok := token.(jws.JWS); ok {
+		if v, ok := j.Protected().Get(name).(string); ok {
+			return v
+		}
+	}
+	return ""
 }
 
 /*
-setPkSafe Safely stores the Public Key (via a Write Lock)
+setKeysSafe Safely stores the Public Keys (via a Write Lock)
 */
-func (a *oauth) setPkSafe(pk *rsa.PublicKey) {
+func (a *oauth) setKeysSafe(keys publicKeys) {
 	a.rwMutex.Lock()
-	a.gPkey = pk
+	a.keys = keys
 	a.rwMutex.Unlock()
 }
 
 /*
-getPkSafe returns the stored key (via a read lock)
+getKeysSafe returns the stored keys (via a read lock)
 */
-func (a *oauth) getPkSafe() *rsa.PublicKey {
+func (a *oauth) getKeysSafe() publicKeys {
 	a.rwMutex.RLock()
-	pk := a.gPkey
+	keys := a.keys
 	a.rwMutex.RUnlock()
-	return pk
+	return keys
 }
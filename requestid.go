@@ -0,0 +1,91 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+const (
+	// DefaultRequestIDHeader is the default name of the HTTP header that
+	// carries the request ID.
+	DefaultRequestIDHeader = "X-Request-ID"
+
+	// maxRequestIDLen is the longest request ID that we accept from a client.
+	maxRequestIDLen = 128
+)
+
+/*
+SetRequestIDHeader sets the name of the HTTP header that carries the request
+ID. Every API call that passes through the scaffold gets an ID, which is
+taken from this header if the client sent a reasonable one, or generated
+otherwise. The ID is placed in the request context (see FetchRequestID),
+returned in the same header on the response, and included in the JSON
+error responses and the access log. The default is DefaultRequestIDHeader.
+An empty name is ignored.
+It must be called before "Listen."
+*/
+func (s *HTTPScaffold) SetRequestIDHeader(name string) {
+	if name != "" {
+		s.requestIDHeader = name
+	}
+}
+
+/*
+FetchRequestID returns the ID that the scaffold assigned to the request,
+or an empty string if there is none.
+*/
+func FetchRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+/*
+assignRequestID finds or creates the ID for a request, adds it to the
+request context and returns it.
+*/
+func (s *HTTPScaffold) assignRequestID(req *http.Request) (string, *http.Request) {
+	id := req.Header.Get(s.requestIDHeader)
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	ctx := context.WithValue(req.Context(), requestIDKey, id)
+	return id, req.WithContext(ctx)
+}
+
+/*
+validRequestID makes sure that an ID from a client is safe to put in
+headers and logs.
+*/
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' || c == '"' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,58 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"net/http"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Request ID tests", func() {
+	It("Validate request IDs", func() {
+		Expect(validRequestID("abc-123")).Should(BeTrue())
+		Expect(validRequestID("")).Should(BeFalse())
+		Expect(validRequestID("has space")).Should(BeFalse())
+		Expect(validRequestID("new\nline")).Should(BeFalse())
+		Expect(validRequestID(`quo"te`)).Should(BeFalse())
+		Expect(validRequestID(strings.Repeat("x", maxRequestIDLen))).Should(BeTrue())
+		Expect(validRequestID(strings.Repeat("x", maxRequestIDLen+1))).Should(BeFalse())
+	})
+
+	It("Assign request IDs", func() {
+		s := CreateHTTPScaffold()
+		req, err := http.NewRequest("GET", "http://localhost/", nil)
+		Expect(err).Should(Succeed())
+		Expect(FetchRequestID(req)).Should(BeEmpty())
+
+		id, newReq := s.assignRequestID(req)
+		Expect(id).Should(HaveLen(32))
+		Expect(FetchRequestID(newReq)).Should(Equal(id))
+
+		req.Header.Set(DefaultRequestIDHeader, "client-id")
+		id, newReq = s.assignRequestID(req)
+		Expect(id).Should(Equal("client-id"))
+		Expect(FetchRequestID(newReq)).Should(Equal("client-id"))
+
+		s.SetRequestIDHeader("X-Correlation-ID")
+		id, _ = s.assignRequestID(req)
+		Expect(id).ShouldNot(Equal("client-id"))
+
+		s.SetRequestIDHeader("")
+		Expect(s.requestIDHeader).Should(Equal("X-Correlation-ID"))
+	})
+})
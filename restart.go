@@ -0,0 +1,256 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+DefaultRestartTimeout is the default amount of time that "Restart" waits
+for the new process to become ready.
+*/
+const DefaultRestartTimeout = 30 * time.Second
+
+/*
+readyFdEnv is the environment variable that tells a new process started by
+"Restart" which file descriptor to use to say that it is ready.
+*/
+const readyFdEnv = "GOSCAFFOLD_READY_FD"
+
+/*
+ErrRestarted is returned by the "Listen" method when the server shut down
+because a new process took over its listeners.
+*/
+var ErrRestarted = errors.New("Restarted")
+
+/*
+restartArgs are the arguments for the new process. If nil, then the
+arguments of this process are used.
+*/
+var restartArgs []string
+
+/*
+fileListener is implemented by the listeners that can be passed to
+another process.
+*/
+type fileListener interface {
+	File() (*os.File, error)
+}
+
+/*
+unlinkListener is implemented by the listeners that remove their Unix
+socket when they are closed.
+*/
+type unlinkListener interface {
+	SetUnlinkOnClose(unlink bool)
+}
+
+/*
+SetRestartTimeout sets the maximum amount of time that "Restart" waits for
+the new process to become ready. The default is DefaultRestartTimeout.
+*/
+func (s *HTTPScaffold) SetRestartTimeout(d time.Duration) {
+	s.restartTimeout = d
+}
+
+/*
+Restart starts a new copy of the program and passes all the listeners to
+it, so that a new version of the program may be deployed without refusing
+any connections. The new process must call "UseInheritedListeners" before
+"Open." Once the new process has started to listen, and "MarkStarted" was
+called if there is a "startupPath," this process stops accepting new
+connections and shuts down as gracefully as it would for "Shutdown," and
+"ErrRestarted" is returned by the "Listen" method. If the new process fails
+or does not become ready before the restart timeout, then it is killed,
+this process keeps running, and an error is returned. An error is also
+returned if the scaffold is not open yet, or if another restart is in
+progress or has already succeeded. "CatchSignals" calls this method on
+SIGUSR2.
+*/
+func (s *HTTPScaffold) Restart() (err error) {
+	s.lock.Lock()
+	if !s.open {
+		s.lock.Unlock()
+		return errors.New("Cannot restart before the scaffold is open")
+	}
+	if s.restarting {
+		s.lock.Unlock()
+		return errors.New("Restart is already in progress")
+	}
+	s.restarting = true
+	roles := []struct {
+		name      string
+		listeners []net.Listener
+	}{
+		{InsecureListenerName, s.insecureListeners},
+		{SecureListenerName, s.secureRaw},
+		{ManagementListenerName, s.mgmtListeners},
+	}
+	s.lock.Unlock()
+
+	var files []*os.File
+	var names []string
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+		if err != nil {
+			s.lock.Lock()
+			s.restarting = false
+			s.lock.Unlock()
+		}
+	}()
+
+	for _, role := range roles {
+		for _, l := range role.listeners {
+			fl, ok := l.(fileListener)
+			if !ok {
+				return fmt.Errorf("Cannot pass listener on %s to a new process", l.Addr())
+			}
+			f, err := fl.File()
+			if err != nil {
+				return err
+			}
+			files = append(files, f)
+			names = append(names, role.name)
+		}
+	}
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyReader.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		readyWriter.Close()
+		return err
+	}
+	args := restartArgs
+	if args == nil {
+		args = os.Args[1:]
+	}
+	cmd := exec.Command(exe, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyWriter)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("LISTEN_FDS=%d", len(files)),
+		fmt.Sprintf("LISTEN_FDNAMES=%s", strings.Join(names, ":")),
+		fmt.Sprintf("%s=%d", readyFdEnv, listenFdsStart+len(files)))
+
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return err
+	}
+
+	err = waitForReady(readyReader, s.restartTimeout)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	cmd.Process.Release()
+
+	// The new process owns the Unix sockets now
+	for _, role := range roles {
+		for _, l := range role.listeners {
+			if ul, ok := l.(unlinkListener); ok {
+				ul.SetUnlinkOnClose(false)
+			}
+		}
+	}
+
+	s.lock.Lock()
+	s.restarted = true
+	s.lock.Unlock()
+
+	// Stop accepting connections. "WaitForShutdown" drains the ones we have.
+	s.Shutdown(ErrRestarted)
+	for _, role := range roles {
+		for _, l := range role.listeners {
+			l.Close()
+		}
+	}
+	return nil
+}
+
+/*
+isRestarted returns true once "Restart" has handed the listeners to a new
+process, so that the servers are expected to stop with an error.
+*/
+func (s *HTTPScaffold) isRestarted() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.restarted
+}
+
+/*
+waitForReady waits for the new process to write to the pipe. If it exits
+first, then the pipe is closed instead.
+*/
+func waitForReady(r *os.File, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = DefaultRestartTimeout
+	}
+	readyChan := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := r.Read(buf)
+		readyChan <- err
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-readyChan:
+		if err != nil {
+			return errors.New("New process exited before it was ready")
+		}
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("New process was not ready after %s", timeout)
+	}
+}
+
+/*
+notifyReady tells the process that started this one using "Restart" that
+this one is ready. It does nothing if this process was not started that way.
+*/
+func notifyReady() {
+	fdStr := os.Getenv(readyFdEnv)
+	if fdStr == "" {
+		return
+	}
+	os.Unsetenv(readyFdEnv)
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	f.Write([]byte{1})
+	f.Close()
+}
@@ -0,0 +1,178 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package goscaffold
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const restartChildEnv = "GOSCAFFOLD_RESTART_CHILD"
+
+var _ = Describe("Restart tests", func() {
+	BeforeEach(func() {
+		restartArgs = []string{"-test.run=^TestRestartChild$"}
+	})
+
+	AfterEach(func() {
+		restartArgs = nil
+		os.Unsetenv(restartChildEnv)
+	})
+
+	It("Restart", func() {
+		os.Setenv(restartChildEnv, "serve")
+		s := CreateHTTPScaffold()
+		s.SetManagementPort(0)
+		s.SetHealthPath("/health")
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		stopChan := make(chan error)
+		go func() {
+			stopChan <- s.Listen(restartHandler("parent"))
+		}()
+
+		Eventually(func() string {
+			_, body := getText(fmt.Sprintf("http://%s", s.InsecureAddress()))
+			return body
+		}, 5*time.Second).Should(Equal("parent"))
+
+		// A request that is in progress completes in this process
+		slowChan := make(chan string, 1)
+		go func() {
+			_, body := getText(fmt.Sprintf("http://%s?wait=500ms", s.InsecureAddress()))
+			slowChan <- body
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		err = s.Restart()
+		Expect(err).Should(Succeed())
+		Expect(s.Restart()).Should(MatchError("Restart is already in progress"))
+		Eventually(slowChan, 5*time.Second).Should(Receive(Equal("parent")))
+		Eventually(stopChan, 5*time.Second).Should(Receive(Equal(ErrRestarted)))
+
+		// The new process is on the same ports
+		code, body := getText(fmt.Sprintf("http://%s", s.InsecureAddress()))
+		Expect(code).Should(Equal(200))
+		Expect(body).Should(HavePrefix("child "))
+		code, _ = getText(fmt.Sprintf("http://%s/health", s.ManagementAddress()))
+		Expect(code).Should(Equal(200))
+
+		pid, err := strconv.Atoi(strings.TrimPrefix(body, "child "))
+		Expect(err).Should(Succeed())
+		Expect(pid).ShouldNot(Equal(os.Getpid()))
+		proc, err := os.FindProcess(pid)
+		Expect(err).Should(Succeed())
+		Expect(proc.Signal(syscall.SIGTERM)).Should(Succeed())
+		Eventually(func() error {
+			_, err := http.Get(fmt.Sprintf("http://%s", s.InsecureAddress()))
+			return err
+		}, 5*time.Second).ShouldNot(Succeed())
+	})
+
+	It("Restart failure", func() {
+		os.Setenv(restartChildEnv, "fail")
+		s := CreateHTTPScaffold()
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		stopChan := make(chan error)
+		go func() {
+			stopChan <- s.Listen(restartHandler("parent"))
+		}()
+
+		Eventually(func() string {
+			_, body := getText(fmt.Sprintf("http://%s", s.InsecureAddress()))
+			return body
+		}, 5*time.Second).Should(Equal("parent"))
+
+		err = s.Restart()
+		Expect(err).Should(MatchError("New process exited before it was ready"))
+		// A failed restart may be tried again
+		err = s.Restart()
+		Expect(err).Should(MatchError("New process exited before it was ready"))
+
+		// Still running
+		_, body := getText(fmt.Sprintf("http://%s", s.InsecureAddress()))
+		Expect(body).Should(Equal("parent"))
+
+		shutdownErr := errors.New("Validate")
+		s.Shutdown(shutdownErr)
+		Eventually(stopChan).Should(Receive(Equal(shutdownErr)))
+	})
+
+	It("Restart before open", func() {
+		s := CreateHTTPScaffold()
+		Expect(s.Restart()).Should(MatchError("Cannot restart before the scaffold is open"))
+
+		// Shutting down before opening stops the server as soon as it opens
+		shutdownErr := errors.New("Validate")
+		s.Shutdown(shutdownErr)
+		Expect(s.Listen(restartHandler("parent"))).Should(Equal(shutdownErr))
+	})
+})
+
+/*
+TestRestartChild is the new process that is started by the restart tests.
+It does nothing when the tests are run normally.
+*/
+func TestRestartChild(t *testing.T) {
+	mode := os.Getenv(restartChildEnv)
+	if mode == "" {
+		return
+	}
+	os.Unsetenv(restartChildEnv)
+
+	s := CreateHTTPScaffold()
+	s.SetHealthPath("/health")
+	err := s.UseInheritedListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode == "fail" {
+		return
+	}
+
+	s.CatchSignals()
+	// Do not outlive the tests if something goes wrong
+	go func() {
+		time.Sleep(30 * time.Second)
+		s.Shutdown(nil)
+	}()
+	s.Listen(restartHandler(fmt.Sprintf("child %d", os.Getpid())))
+}
+
+func restartHandler(msg string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wait := r.URL.Query().Get("wait"); wait != "" {
+			d, _ := time.ParseDuration(wait)
+			time.Sleep(d)
+		}
+		w.Write([]byte(msg))
+	})
+}
@@ -15,15 +15,19 @@
 package goscaffold
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -33,6 +37,10 @@ const (
 	// to complete. Default is 30 seconds, which is also the default grace period
 	// in Kubernetes.
 	DefaultGraceTimeout = 30 * time.Second
+	// DefaultPreDrainDelay is the default amount of time to keep serving
+	// requests after shutdown was requested and before we start to drain.
+	// By default there is no delay.
+	DefaultPreDrainDelay = 0 * time.Second
 )
 
 /*
@@ -51,6 +59,12 @@ ErrMarkedDown is used after being marked down but before being shut down.
 */
 var ErrMarkedDown = errors.New("Marked down")
 
+/*
+ErrStarting is used after a startup path was set but before "MarkStarted"
+is called.
+*/
+var ErrStarting = errors.New("Starting")
+
 /*
 HealthStatus is a type of response from a health check.
 */
@@ -65,6 +79,8 @@ const (
 	NotReady HealthStatus = iota
 	// Failed denotes that the server is bad
 	Failed HealthStatus = iota
+	// Starting denotes that the server is OK, but has not finished starting up
+	Starting HealthStatus = iota
 )
 
 /*
@@ -87,6 +103,33 @@ the scaffold will always invoke it inside a new goroutine.
 */
 type MarkdownHandler func()
 
+/*
+MarkupHandler is the counterpart of MarkdownHandler. It is invoked when the
+server is marked up again after being marked down.
+*/
+type MarkupHandler func()
+
+/*
+ServerOptions contains settings for the HTTP servers that the scaffold
+creates for each listener. They have the same meaning as the fields of
+the same name in http.Server. Zero values leave the defaults from the
+"http" package in place.
+DrainTimeout is the only exception. It is how long requests that are still
+running when the grace timeout expires have to respond after their contexts
+are cancelled, before their connections are closed. It adds to the grace
+timeout, so the two together should fit in the grace period of the
+environment. By default those connections are closed right away.
+*/
+type ServerOptions struct {
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	ErrorLog          *log.Logger
+	DrainTimeout      time.Duration
+}
+
 /*
 An HTTPScaffold provides a set of features on top of a standard HTTP
 listener. It includes an HTTP handler that may be plugged in to any
@@ -98,19 +141,60 @@ type HTTPScaffold struct {
 	securePort         int
 	managementPort     int
 	open               bool
-	ipAddr             net.IP
+	bindAddresses      []string
 	tracker            *requestTracker
-	insecureListener   net.Listener
-	secureListener     net.Listener
-	managementListener net.Listener
+	insecureListeners  []net.Listener
+	secureListeners    []net.Listener
+	mgmtListeners      []net.Listener
+	insecureSocket     *unixSocket
+	mgmtSocket         *unixSocket
+	presetInsecure     []net.Listener
+	presetSecure       []net.Listener
+	presetMgmt         []net.Listener
+	secureRaw          []net.Listener
+	restartTimeout     time.Duration
+	listening          int32
 	healthCheck        HealthChecker
+	healthChecks       []*healthCheck
+	healthInterval     time.Duration
+	healthDeadline     time.Duration
+	healthCache        *healthCache
 	healthPath         string
 	readyPath          string
+	startupPath        string
+	metricsPath        string
+	metrics            *requestMetrics
+	accessLog          *accessLog
+	requestIDHeader    string
+	starting           int32
 	markdownPath       string
 	markdownMethod     string
 	markdownHandler    MarkdownHandler
+	markupPath         string
+	markupMethod       string
+	markupHandler      MarkupHandler
 	certFile           string
 	keyFile            string
+	keyPassword        PasswordFunc
+	clientCAFile       string
+	clientAuth         ClientAuthMode
+	certificates       []certificateSource
+	certDirectory      string
+	certificatesPath   string
+	certReloadInterval time.Duration
+	certReloadSignal   os.Signal
+	certExpiryWindow   time.Duration
+	certExpiryCritical bool
+	tlsOptions         TLSOptions
+	certLoader         *certificateLoader
+	graceTimeout       time.Duration
+	preDrainDelay      time.Duration
+	serverOptions      ServerOptions
+	servers            []*http.Server
+	restarting         bool
+	restarted          bool
+	pendingShutdown    error
+	lock               sync.Mutex
 }
 
 /*
@@ -119,20 +203,31 @@ do nothing.
 */
 func CreateHTTPScaffold() *HTTPScaffold {
 	return &HTTPScaffold{
-		insecurePort:   0,
-		securePort:     -1,
-		managementPort: -1,
-		ipAddr:         []byte{0, 0, 0, 0},
-		open:           false,
+		insecurePort:    0,
+		securePort:      -1,
+		managementPort:  -1,
+		bindAddresses:   []string{"0.0.0.0"},
+		open:            false,
+		graceTimeout:    DefaultGraceTimeout,
+		preDrainDelay:   DefaultPreDrainDelay,
+		healthCache:     &healthCache{},
+		metrics:         newRequestMetrics(),
+		requestIDHeader: DefaultRequestIDHeader,
 	}
 }
 
 /*
 SetlocalBindIPAddressV4 seta the IP address (IP V4) for the service to
 bind on to listen on. If none set, all IP addesses would be accepted.
+It is the same as calling "SetBindAddress" with a single address, and
+a nil address means all addresses.
 */
 func (s *HTTPScaffold) SetlocalBindIPAddressV4(ip net.IP) {
-	s.ipAddr = ip
+	if ip == nil {
+		s.SetBindAddress("0.0.0.0")
+	} else {
+		s.SetBindAddress(ip.String())
+	}
 }
 
 /*
@@ -157,26 +252,40 @@ func (s *HTTPScaffold) SetSecurePort(port int) {
 
 /*
 InsecureAddress returns the actual address (including the port if an
-ephemeral port was used) where we are listening. It must only be
+ephemeral port was used) where we are listening. If there is more than
+one bind address, then it returns the first one. It must only be
 called after "Listen."
 */
 func (s *HTTPScaffold) InsecureAddress() string {
-	if s.insecureListener == nil {
-		return ""
-	}
-	return s.insecureListener.Addr().String()
+	return firstAddress(s.insecureListeners)
+}
+
+/*
+InsecureAddresses returns the addresses of all the insecure listeners, in
+the same order as the addresses passed to "SetBindAddress," followed by the
+Unix domain socket if there is one. It must only be called after "Listen."
+*/
+func (s *HTTPScaffold) InsecureAddresses() []string {
+	return listenerAddresses(s.insecureListeners)
 }
 
 /*
 SecureAddress returns the actual address (including the port if an
-ephemeral port was used) where we are listening on HTTPS. It must only be
+ephemeral port was used) where we are listening on HTTPS. If there is more
+than one bind address, then it returns the first one. It must only be
 called after "Listen."
 */
 func (s *HTTPScaffold) SecureAddress() string {
-	if s.secureListener == nil {
-		return ""
-	}
-	return s.secureListener.Addr().String()
+	return firstAddress(s.secureListeners)
+}
+
+/*
+SecureAddresses returns the addresses of all the secure listeners, in
+the same order as the addresses passed to "SetBindAddress." It must only
+be called after "Listen."
+*/
+func (s *HTTPScaffold) SecureAddresses() []string {
+	return listenerAddresses(s.secureListeners)
 }
 
 /*
@@ -194,10 +303,16 @@ ephemeral port was used) where we are listening for management
 operations. If "SetManagementPort" was not set, then it returns null.
 */
 func (s *HTTPScaffold) ManagementAddress() string {
-	if s.managementListener == nil {
-		return ""
-	}
-	return s.managementListener.Addr().String()
+	return firstAddress(s.mgmtListeners)
+}
+
+/*
+ManagementAddresses returns the addresses of all the management listeners, in
+the same order as the addresses passed to "SetBindAddress," followed by the
+Unix domain socket if there is one. It must only be called after "Listen."
+*/
+func (s *HTTPScaffold) ManagementAddresses() []string {
+	return listenerAddresses(s.mgmtListeners)
 }
 
 /*
@@ -211,11 +326,44 @@ func (s *HTTPScaffold) SetCertFile(fn string) {
 /*
 SetKeyFile sets the name of the file that the server will read to get its
 own TLS key. It is only consulted if "securePort" is >= 0.
-If "getPass" is non-null, then the function will be called at startup time
-to retrieve the password for the key file.
+Use "SetKeyFileWithPassword" if the key file is encrypted.
 */
 func (s *HTTPScaffold) SetKeyFile(fn string) {
 	s.keyFile = fn
+	s.keyPassword = nil
+}
+
+/*
+SetGraceTimeout sets the maximum amount of time that the server will wait
+for outstanding requests to complete once it has started to shut down.
+It should be a bit shorter than the grace period of the environment,
+such as "terminationGracePeriodSeconds" in Kubernetes.
+It must be called before "Open" or "Listen". The default is
+DefaultGraceTimeout.
+*/
+func (s *HTTPScaffold) SetGraceTimeout(d time.Duration) {
+	s.graceTimeout = d
+}
+
+/*
+SetPreDrainDelay sets an amount of time that the server will keep on
+serving requests normally after it has been asked to shut down. The
+"readyPath" will keep on returning 200 during this time, so that load
+balancers and service endpoints have time to stop routing traffic here.
+Once the delay expires, the server is marked down and the grace timeout
+starts. The delay is skipped if the server was already marked down.
+It must be called before "Open" or "Listen". The default is no delay.
+*/
+func (s *HTTPScaffold) SetPreDrainDelay(d time.Duration) {
+	s.preDrainDelay = d
+}
+
+/*
+SetServerOptions sets the timeouts and other options of the HTTP servers
+that will listen on every port. It must be called before "Listen."
+*/
+func (s *HTTPScaffold) SetServerOptions(o ServerOptions) {
+	s.serverOptions = o
 }
 
 /*
@@ -225,6 +373,8 @@ it will return 503 if the function returns "Failed" and 200 otherwise.
 This path is intended to be used by systems like Kubernetes as the
 "health check." These systems will shut down the server if we return
 a non-200 URL.
+If the client asks for JSON, then the response is a document that includes
+the result of every check that was added using "AddHealthCheck."
 */
 func (s *HTTPScaffold) SetHealthPath(p string) {
 	s.healthPath = p
@@ -235,14 +385,50 @@ SetReadyPath sets up a readines check on the management port (if set) or
 otherwise the main port. If a health check function has been supplied,
 it will return 503 if the function returns "Failed" or "Not Ready".
 It will also return 503 if the "Shutdown" function was called
-(or caught by signal handler). This path is intended to be used by
+(or caught by signal handler), or if a startup path was set and
+"MarkStarted" has not been called yet. This path is intended to be used by
 load balancers that will decide whether to route calls, but not by
 systems like Kubernetes that will decide to shut down this server.
+It returns the same JSON document as the "healthPath."
 */
 func (s *HTTPScaffold) SetReadyPath(p string) {
 	s.readyPath = p
 }
 
+/*
+SetStartupPath sets up a startup check on the management port (if set) or
+otherwise the main port. Setting it also puts the server in the "Starting"
+state, and it stays there until "MarkStarted" is called. Until then,
+this path and the "readyPath" will return 503 and a status of "Starting."
+Afterwards, this path responds just like the "healthPath."
+This path is intended to be used as a "startupProbe" in Kubernetes, so that
+a server that takes a long time to warm up is not killed by the
+"livenessProbe" in the meantime.
+Setting it to an empty string removes the path, and the server is no longer
+in the "Starting" state.
+It must be called before "Listen."
+*/
+func (s *HTTPScaffold) SetStartupPath(p string) {
+	s.startupPath = p
+	if p == "" {
+		atomic.StoreInt32(&s.starting, 0)
+	} else {
+		atomic.StoreInt32(&s.starting, 1)
+	}
+}
+
+/*
+MarkStarted indicates that the application has finished starting up, so that
+the "startupPath" and "readyPath" may return 200. It has no effect unless
+"SetStartupPath" was called. It is safe to call more than once.
+*/
+func (s *HTTPScaffold) MarkStarted() {
+	atomic.StoreInt32(&s.starting, 0)
+	if atomic.LoadInt32(&s.listening) != 0 {
+		notifyReady()
+	}
+}
+
 /*
 SetMarkdown sets up a URI that will cause the server to mark it
 self down. However, this URI will not cause the server to actually shut
@@ -265,6 +451,53 @@ func (s *HTTPScaffold) SetMarkdown(method, path string, handler MarkdownHandler)
 	s.markdownHandler = handler
 }
 
+/*
+SetMarkup sets up a URI that reverses the effect of the markdown URI. Once any
+HTTP request is received on this path with a matching method, the server
+will be marked up, so that the "readyPath" and all other HTTP calls work
+normally again. If "handler" is not nil, the handler will be invoked
+before the API call returns. It is not possible to mark up a server
+once it has started to shut down, and in that case the URI will return 503.
+This is intended for blue/green deployments and maintenance windows,
+where a server is taken out of the load balancer for a while but not
+shut down.
+*/
+func (s *HTTPScaffold) SetMarkup(method, path string, handler MarkupHandler) {
+	s.markupPath = path
+	s.markupMethod = method
+	s.markupHandler = handler
+}
+
+/*
+MarkDown marks the server down just like the markdown URI, and invokes the
+handler that was passed to "SetMarkdown," if any. The server will not shut
+down, but the "readyPath" and all other HTTP calls will return 503 until
+"MarkUp" is called. The handler is not invoked if the server was already
+marked down or is shutting down. It must only be called after "Open."
+*/
+func (s *HTTPScaffold) MarkDown() {
+	if s.tracker.markDown() && s.markdownHandler != nil {
+		s.markdownHandler()
+	}
+}
+
+/*
+MarkUp reverses the effect of "MarkDown" or of the markdown URI, and invokes
+the handler that was passed to "SetMarkup," if any. It returns an error
+if the server has already started to shut down.
+It must only be called after "Open."
+*/
+func (s *HTTPScaffold) MarkUp() error {
+	err := s.tracker.markUp()
+	if err != nil {
+		return err
+	}
+	if s.markupHandler != nil {
+		s.markupHandler()
+	}
+	return nil
+}
+
 /*
 SetHealthChecker specifies a function that the scaffold will call every time
 "HealthPath" or "ReadyPath" is invoked.
@@ -280,65 +513,46 @@ retrieve the actual address where the server is listening before we actually
 start to listen.
 */
 func (s *HTTPScaffold) Open() error {
-	s.tracker = startRequestTracker(DefaultGraceTimeout)
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
-	if s.insecurePort >= 0 {
-		il, err := net.ListenTCP("tcp", &net.TCPAddr{
-			IP:   s.ipAddr,
-			Port: s.insecurePort,
-		})
-		if err != nil {
-			return err
-		}
-		s.insecureListener = il
-		defer func() {
-			if !s.open {
-				il.Close()
-			}
-		}()
+	s.tracker = startRequestTracker(s.graceTimeout, s.preDrainDelay)
+	if s.pendingShutdown != nil {
+		s.tracker.shutdown(s.pendingShutdown)
 	}
 
-	if s.securePort >= 0 {
-		if s.keyFile == "" || s.certFile == "" {
-			return errors.New("key and certificate files must be set")
+	defer func() {
+		if !s.open {
+			s.closeListeners()
 		}
-		cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	}()
+
+	ls, err := s.openListeners(s.presetInsecure, s.insecurePort, s.insecureSocket)
+	if err != nil {
+		return err
+	}
+	s.insecureListeners = ls
+
+	if s.securePort >= 0 || len(s.presetSecure) > 0 {
+		tlsConfig, err := s.createTLSConfig()
 		if err != nil {
 			return err
 		}
-		tlsConfig := &tls.Config{
-			Certificates: []tls.Certificate{cert},
-		}
-		sl, err := net.ListenTCP("tcp", &net.TCPAddr{
-			IP:   s.ipAddr,
-			Port: s.securePort,
-		})
+		ls, err := s.openListeners(s.presetSecure, s.securePort, nil)
 		if err != nil {
 			return err
 		}
-		defer func() {
-			if !s.open {
-				sl.Close()
-			}
-		}()
-		s.secureListener = tls.NewListener(sl, tlsConfig)
+		s.secureRaw = ls
+		for _, l := range ls {
+			s.secureListeners = append(s.secureListeners, tls.NewListener(l, tlsConfig))
+		}
 	}
 
-	if s.managementPort >= 0 {
-		ml, err := net.ListenTCP("tcp", &net.TCPAddr{
-			IP:   s.ipAddr,
-			Port: s.managementPort,
-		})
-		if err != nil {
-			return err
-		}
-		s.managementListener = ml
-		defer func() {
-			if !s.open {
-				ml.Close()
-			}
-		}()
+	ls, err = s.openListeners(s.presetMgmt, s.managementPort, s.mgmtSocket)
+	if err != nil {
+		return err
 	}
+	s.mgmtListeners = ls
 
 	s.open = true
 	return nil
@@ -350,12 +564,14 @@ libraries. It will open a port (or ports) and begin listening for
 HTTP traffic.
 */
 func (s *HTTPScaffold) StartListen(baseHandler http.Handler) error {
-	if !s.open {
+	s.lock.Lock()
+	open := s.open
+	s.lock.Unlock()
+	if !open {
 		err := s.Open()
 		if err != nil {
 			return err
 		}
-		s.open = true
 	}
 
 	// This is the handler that wraps customer API calls with tracking
@@ -365,26 +581,79 @@ func (s *HTTPScaffold) StartListen(baseHandler http.Handler) error {
 	}
 	mgmtHandler := s.createManagementHandler()
 
+	if s.healthInterval > 0 {
+		go s.runHealthChecks(s.tracker.graceCtx.Done())
+	}
+	if s.certLoader != nil && s.certReloadInterval > 0 {
+		go s.certLoader.watch(s.certReloadInterval, s.tracker.graceCtx.Done())
+	}
+
 	var mainHandler http.Handler
-	if s.managementPort >= 0 {
+	if len(s.mgmtListeners) > 0 {
 		// Management on separate port
 		mainHandler = trackingHandler
-		go http.Serve(s.managementListener, mgmtHandler)
+		for _, l := range s.mgmtListeners {
+			s.serve(l, mgmtHandler)
+		}
 	} else {
 		// Management on same port
 		mgmtHandler.child = trackingHandler
 		mainHandler = mgmtHandler
 	}
 
-	if s.insecureListener != nil {
-		go http.Serve(s.insecureListener, mainHandler)
+	for _, l := range s.insecureListeners {
+		s.serve(l, mainHandler)
+	}
+	for _, l := range s.secureListeners {
+		s.serve(l, mainHandler)
 	}
-	if s.secureListener != nil {
-		go http.Serve(s.secureListener, mainHandler)
+
+	atomic.StoreInt32(&s.listening, 1)
+	if !s.isStarting() {
+		notifyReady()
 	}
 	return nil
 }
 
+/*
+serve creates a new HTTP server for the listener and starts it in a new
+goroutine. If the server fails, then the scaffold is shut down right away,
+without the pre-drain delay or the grace timeout, and the error is returned
+by "WaitForShutdown."
+*/
+func (s *HTTPScaffold) serve(l net.Listener, handler http.Handler) {
+	srv := &http.Server{
+		Handler:           handler,
+		ReadTimeout:       s.serverOptions.ReadTimeout,
+		ReadHeaderTimeout: s.serverOptions.ReadHeaderTimeout,
+		WriteTimeout:      s.serverOptions.WriteTimeout,
+		IdleTimeout:       s.serverOptions.IdleTimeout,
+		MaxHeaderBytes:    s.serverOptions.MaxHeaderBytes,
+		ErrorLog:          s.serverOptions.ErrorLog,
+	}
+	s.lock.Lock()
+	s.servers = append(s.servers, srv)
+	s.lock.Unlock()
+
+	go func() {
+		err := srv.Serve(l)
+		if err != http.ErrServerClosed && !s.isRestarted() {
+			s.tracker.abort(err)
+		}
+	}()
+}
+
+/*
+logf logs to the "ErrorLog" from the server options, or the standard logger.
+*/
+func (s *HTTPScaffold) logf(format string, args ...interface{}) {
+	if s.serverOptions.ErrorLog != nil {
+		s.serverOptions.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
 /*
 WaitForShutdown blocks until we are shut down.
 It will use the graceful shutdown logic to ensure that once marked down,
@@ -397,20 +666,24 @@ This method will block until the server is shutdown using "Shutdown" or one of
 the other shutdown mechanisms. It must not be called until after
 "StartListenen"
 When shut down, this method will return the error that was passed to the "shutdown"
-method.
+method, or the error that caused one of the HTTP servers to fail.
+Once all requests are complete, idle keep-alive connections are closed
+before this method returns. Connections that are still busy when the grace
+timeout (plus the "DrainTimeout" from the server options) expires are closed
+forcibly.
 */
 func (s *HTTPScaffold) WaitForShutdown() error {
 	err := <-s.tracker.C
 
-	if s.insecureListener != nil {
-		s.insecureListener.Close()
-	}
-	if s.secureListener != nil {
-		s.secureListener.Close()
-	}
-	if s.managementListener != nil {
-		s.managementListener.Close()
+	deadline := s.tracker.drainDeadline().Add(s.serverOptions.DrainTimeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	for _, srv := range s.servers {
+		if srv.Shutdown(ctx) != nil {
+			srv.Close()
+		}
 	}
+	cancel()
+	s.closeListeners()
 
 	return err
 }
@@ -432,22 +705,43 @@ func (s *HTTPScaffold) Listen(baseHandler http.Handler) error {
 Shutdown indicates that the server should stop handling incoming requests
 and exit from the "Serve" call. This may be called automatically by
 calling "CatchSignals," or automatically using this call. If
-"reason" is nil, a default reason will be assigned.
+"reason" is nil, a default reason will be assigned. If it is called before
+"Open," then the server shuts down as soon as it is opened.
 */
 func (s *HTTPScaffold) Shutdown(reason error) {
 	if reason == nil {
-		s.tracker.shutdown(ErrManualStop)
+		reason = ErrManualStop
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.tracker == nil {
+		s.pendingShutdown = reason
 	} else {
 		s.tracker.shutdown(reason)
 	}
 }
 
+/*
+ShutdownContext returns a context that is cancelled as soon as the server
+is marked down, either by the markdown path or because shutdown has started.
+If the server is marked up again, then a new context is returned.
+Background workers may use it to know when to stop. The context of each
+request handled by the scaffold is different: it is only cancelled once
+the grace timeout expires. It must only be called after "Open."
+*/
+func (s *HTTPScaffold) ShutdownContext() context.Context {
+	return s.tracker.shutdownContext()
+}
+
 /*
 CatchSignals directs the scaffold to listen for common signals. It catches
-three signals. SIGINT (aka control-C) and SIGTERM (what "kill" sends by default)
+four signals. SIGINT (aka control-C) and SIGTERM (what "kill" sends by default)
 will cause the program to be marked down, and "SignalCaught" will be returned
 by the "Listen" method. SIGHUP ("kill -1" or "kill -HUP") will cause the
 stack trace of all the threads to be printed to stderr, just like a Java program.
+SIGUSR2 calls "Restart," which is not supported on Windows. The signal
+from "SetCertReloadSignal," if any, reloads the TLS certificates.
 This method is very simplistic -- it starts listening every time that
 you call it. So a program should only call it once.
 */
@@ -464,10 +758,24 @@ func (s *HTTPScaffold) CatchSignalsTo(out io.Writer) {
 	signal.Notify(sigChan, syscall.SIGINT)
 	signal.Notify(sigChan, syscall.SIGTERM)
 	signal.Notify(sigChan, syscall.SIGHUP)
+	if restartSignal != nil {
+		signal.Notify(sigChan, restartSignal)
+	}
+	reloadSignal := s.certReloadSignal
+	if reloadSignal != nil {
+		signal.Notify(sigChan, reloadSignal)
+	}
 
 	go func() {
 		for {
 			sig := <-sigChan
+			if reloadSignal != nil && sig == reloadSignal {
+				err := s.ReloadCertificates()
+				if err != nil {
+					fmt.Fprintf(out, "Certificate reload failed: %s\n", err)
+				}
+				continue
+			}
 			switch sig {
 			case syscall.SIGINT, syscall.SIGTERM:
 				s.Shutdown(ErrSignalCaught)
@@ -475,6 +783,13 @@ func (s *HTTPScaffold) CatchSignalsTo(out io.Writer) {
 				return
 			case syscall.SIGHUP:
 				dumpStack(out)
+			case restartSignal:
+				go func() {
+					err := s.Restart()
+					if err != nil {
+						fmt.Fprintf(out, "Restart failed: %s\n", err)
+					}
+				}()
 			}
 		}
 	}()
@@ -16,6 +16,7 @@ package goscaffold
 
 import (
 	"bytes"
+	"crypto/rsa"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -24,6 +25,7 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -227,6 +229,196 @@ var _ = Describe("Scaffold Tests", func() {
 		Eventually(stopChan).Should(Receive(Equal(stopErr)))
 	})
 
+	It("Cancel requests after grace timeout", func() {
+		s := CreateHTTPScaffold()
+		s.SetGraceTimeout(time.Second)
+		// Give the cancelled request time to respond
+		s.SetServerOptions(ServerOptions{DrainTimeout: time.Second})
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+		Expect(s.ShutdownContext().Err()).Should(BeNil())
+
+		go func() {
+			stopErr := s.Listen(&testHandler{})
+			stopChan <- stopErr
+		}()
+
+		Eventually(func() bool {
+			return testGet(s, "")
+		}, 5*time.Second).Should(BeTrue())
+
+		// This request would run for a minute unless it is cancelled
+		codeChan := make(chan int, 1)
+		go func() {
+			code, _ := getText(fmt.Sprintf("http://%s?wait=1m", s.InsecureAddress()))
+			codeChan <- code
+		}()
+		time.Sleep(250 * time.Millisecond)
+
+		stopErr := errors.New("Stop")
+		s.Shutdown(stopErr)
+		Eventually(s.ShutdownContext().Done()).Should(BeClosed())
+		Eventually(stopChan, 2*time.Second).Should(Receive(Equal(stopErr)))
+		Eventually(codeChan, 2*time.Second).Should(Receive(Equal(http.StatusGatewayTimeout)))
+	})
+
+	It("Server options", func() {
+		s := CreateHTTPScaffold()
+		s.SetServerOptions(ServerOptions{
+			ReadTimeout:    5 * time.Second,
+			MaxHeaderBytes: 1024,
+		})
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopErr := s.Listen(&testHandler{})
+			stopChan <- stopErr
+		}()
+
+		Eventually(func() bool {
+			return testGet(s, "")
+		}, 5*time.Second).Should(BeTrue())
+
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://%s", s.InsecureAddress()), nil)
+		Expect(err).Should(Succeed())
+		req.Header.Set("X-Big", strings.Repeat("x", 8192))
+		// Use a new connection because the limit is not enforced in the same
+		// way on a kept-alive connection
+		client := &http.Client{Transport: &http.Transport{}}
+		resp, err := client.Do(req)
+		Expect(err).Should(Succeed())
+		resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(http.StatusRequestHeaderFieldsTooLarge))
+
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+	})
+
+	It("Serve error", func() {
+		s := CreateHTTPScaffold()
+		// A failed server does not wait for either of these
+		s.SetPreDrainDelay(time.Minute)
+		s.SetGraceTimeout(time.Minute)
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopErr := s.Listen(&testHandler{})
+			stopChan <- stopErr
+		}()
+
+		Eventually(func() bool {
+			return testGet(s, "")
+		}, 5*time.Second).Should(BeTrue())
+
+		// Pull the listener out from under the server
+		s.insecureListeners[0].Close()
+		var stopErr error
+		Eventually(stopChan).Should(Receive(&stopErr))
+		Expect(stopErr).ShouldNot(BeNil())
+		Expect(stopErr).ShouldNot(Equal(ErrManualStop))
+	})
+
+	It("Markup", func() {
+		var markedUp int32
+		var markedDown int32
+
+		s := CreateHTTPScaffold()
+		s.SetReadyPath("/ready")
+		s.SetMarkdown("POST", "/markdown", func() {
+			atomic.AddInt32(&markedDown, 1)
+		})
+		s.SetMarkup("POST", "/markup", func() {
+			atomic.AddInt32(&markedUp, 1)
+		})
+
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			listenErr := s.Listen(&testHandler{})
+			stopChan <- listenErr
+		}()
+
+		Eventually(func() bool {
+			return testGet(s, "")
+		}, 5*time.Second).Should(BeTrue())
+
+		resp, err := http.Post(fmt.Sprintf("http://%s/markdown", s.InsecureAddress()),
+			"text/plain", strings.NewReader("Goodbye!"))
+		Expect(err).Should(Succeed())
+		resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(200))
+		code, _ := getText(fmt.Sprintf("http://%s/ready", s.InsecureAddress()))
+		Expect(code).Should(Equal(503))
+		Expect(s.ShutdownContext().Done()).Should(BeClosed())
+
+		resp, err = http.Post(fmt.Sprintf("http://%s/markup", s.InsecureAddress()),
+			"text/plain", strings.NewReader("Hello!"))
+		Expect(err).Should(Succeed())
+		resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(200))
+		Expect(atomic.LoadInt32(&markedUp)).Should(BeEquivalentTo(1))
+		code, _ = getText(fmt.Sprintf("http://%s/ready", s.InsecureAddress()))
+		Expect(code).Should(Equal(200))
+		code, _ = getText(fmt.Sprintf("http://%s", s.InsecureAddress()))
+		Expect(code).Should(Equal(200))
+		Expect(s.ShutdownContext().Done()).ShouldNot(BeClosed())
+
+		// And using the API. The handler is only called once.
+		s.MarkDown()
+		s.MarkDown()
+		Expect(atomic.LoadInt32(&markedDown)).Should(BeEquivalentTo(2))
+		code, _ = getText(fmt.Sprintf("http://%s", s.InsecureAddress()))
+		Expect(code).Should(Equal(503))
+		Expect(s.MarkUp()).Should(Succeed())
+		code, _ = getText(fmt.Sprintf("http://%s", s.InsecureAddress()))
+		Expect(code).Should(Equal(200))
+		Expect(atomic.LoadInt32(&markedUp)).Should(BeEquivalentTo(2))
+
+		stopErr := errors.New("Test stop")
+		s.Shutdown(stopErr)
+		Eventually(stopChan).Should(Receive(Equal(stopErr)))
+		s.MarkDown()
+		Expect(atomic.LoadInt32(&markedDown)).Should(BeEquivalentTo(2))
+		Expect(s.MarkUp()).Should(Equal(stopErr))
+	})
+
+	It("Access log", func() {
+		out := &syncBuffer{}
+		s := CreateHTTPScaffold()
+		s.SetHealthPath("/health")
+		s.SetAccessLog(out, CommonLogFormat)
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopErr := s.Listen(&testHandler{})
+			stopChan <- stopErr
+		}()
+
+		Eventually(func() bool {
+			return testGet(s, "")
+		}, 5*time.Second).Should(BeTrue())
+		code, _ := getText(fmt.Sprintf("http://%s/health", s.InsecureAddress()))
+		Expect(code).Should(Equal(200))
+		code, _ = getText(fmt.Sprintf("http://%s/foo?delay=bar", s.InsecureAddress()))
+		Expect(code).Should(Equal(400))
+
+		Eventually(out.String).Should(ContainSubstring(`"GET /foo?delay=bar HTTP/1.1" 400 -`))
+		Expect(out.String()).Should(ContainSubstring(`"GET / HTTP/1.1" 200 -`))
+		Expect(out.String()).ShouldNot(ContainSubstring("/health"))
+
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+	})
+
 	It("Health Check Functions", func() {
 		status := int32(OK)
 		var healthErr = &atomic.Value{}
@@ -310,6 +502,188 @@ var _ = Describe("Scaffold Tests", func() {
 		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
 	})
 
+	It("Health Check Report", func() {
+		status := int32(OK)
+
+		s := CreateHTTPScaffold()
+		s.SetHealthPath("/health")
+		s.SetReadyPath("/ready")
+		s.AddHealthCheck("database", time.Second, true, func() (HealthStatus, error) {
+			return HealthStatus(atomic.LoadInt32(&status)), nil
+		})
+		s.AddHealthCheck("cache", time.Second, false, func() (HealthStatus, error) {
+			return Failed, errors.New("No cache")
+		})
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopErr := s.Listen(&testHandler{})
+			stopChan <- stopErr
+		}()
+
+		Eventually(func() bool {
+			return testGet(s, "")
+		}, 5*time.Second).Should(BeTrue())
+
+		// Non-critical checks are only reported
+		code, report := getReport(fmt.Sprintf("http://%s/ready", s.InsecureAddress()))
+		Expect(code).Should(Equal(200))
+		Expect(report.Status).Should(Equal("OK"))
+		Expect(report.Checks).Should(HaveLen(2))
+		Expect(report.Checks[0].Name).Should(Equal("database"))
+		Expect(report.Checks[0].Status).Should(Equal("OK"))
+		Expect(report.Checks[0].Latency).ShouldNot(BeEmpty())
+		Expect(report.Checks[1].Name).Should(Equal("cache"))
+		Expect(report.Checks[1].Status).Should(Equal("Failed"))
+		Expect(report.Checks[1].Error).Should(Equal("No cache"))
+
+		atomic.StoreInt32(&status, int32(NotReady))
+		code, report = getReport(fmt.Sprintf("http://%s/health", s.InsecureAddress()))
+		Expect(code).Should(Equal(200))
+		Expect(report.Status).Should(Equal("NotReady"))
+		code, report = getReport(fmt.Sprintf("http://%s/ready", s.InsecureAddress()))
+		Expect(code).Should(Equal(503))
+		Expect(report.Status).Should(Equal("NotReady"))
+		Expect(report.Reason).Should(Equal("database: NotReady"))
+		code, bod := getText(fmt.Sprintf("http://%s/ready", s.InsecureAddress()))
+		Expect(code).Should(Equal(503))
+		Expect(bod).Should(Equal("database: NotReady"))
+
+		atomic.StoreInt32(&status, int32(Failed))
+		code, report = getReport(fmt.Sprintf("http://%s/health", s.InsecureAddress()))
+		Expect(code).Should(Equal(503))
+		Expect(report.Status).Should(Equal("Failed"))
+
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+	})
+
+	It("Startup path", func() {
+		s := CreateHTTPScaffold()
+		s.SetHealthPath("/health")
+		s.SetReadyPath("/ready")
+		s.SetStartupPath("/startup")
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopErr := s.Listen(&testHandler{})
+			stopChan <- stopErr
+		}()
+
+		Eventually(func() bool {
+			return testGet(s, "")
+		}, 5*time.Second).Should(BeTrue())
+
+		// Healthy, but neither started nor ready
+		code, _ := getText(fmt.Sprintf("http://%s/health", s.InsecureAddress()))
+		Expect(code).Should(Equal(200))
+		code, bod := getText(fmt.Sprintf("http://%s/startup", s.InsecureAddress()))
+		Expect(code).Should(Equal(503))
+		Expect(bod).Should(Equal("Starting"))
+		code, js := getJSON(fmt.Sprintf("http://%s/ready", s.InsecureAddress()))
+		Expect(code).Should(Equal(503))
+		Expect(js["status"]).Should(Equal("Starting"))
+
+		s.MarkStarted()
+		code, _ = getText(fmt.Sprintf("http://%s/startup", s.InsecureAddress()))
+		Expect(code).Should(Equal(200))
+		code, _ = getText(fmt.Sprintf("http://%s/ready", s.InsecureAddress()))
+		Expect(code).Should(Equal(200))
+
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+
+		// No startup path, so no need to call MarkStarted
+		s = CreateHTTPScaffold()
+		s.SetStartupPath("/startup")
+		s.SetStartupPath("")
+		Expect(s.isStarting()).Should(BeFalse())
+	})
+
+	It("Metrics", func() {
+		s := CreateHTTPScaffold()
+		s.SetManagementPort(0)
+		s.SetMetricsPath("/metrics")
+		s.SetMarkdown("POST", "/markdown", nil)
+		var checks int32
+		s.AddHealthCheck("database", time.Second, true, func() (HealthStatus, error) {
+			atomic.AddInt32(&checks, 1)
+			return OK, nil
+		})
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopErr := s.Listen(&testHandler{})
+			stopChan <- stopErr
+		}()
+
+		Eventually(func() bool {
+			return testGet(s, "")
+		}, 5*time.Second).Should(BeTrue())
+		code, _ := getText(fmt.Sprintf("http://%s?delay=foo", s.InsecureAddress()))
+		Expect(code).Should(Equal(400))
+
+		resp, err := http.Get(fmt.Sprintf("http://%s/metrics", s.ManagementAddress()))
+		Expect(err).Should(Succeed())
+		Expect(resp.StatusCode).Should(Equal(200))
+		Expect(resp.Header.Get("Content-Type")).Should(HavePrefix("text/plain; version=0.0.4"))
+		bod, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		Expect(err).Should(Succeed())
+		metrics := string(bod)
+		Expect(metrics).Should(ContainSubstring("goscaffold_http_requests_total{code=\"200\"} 1\n"))
+		Expect(metrics).Should(ContainSubstring("goscaffold_http_requests_total{code=\"400\"} 1\n"))
+		Expect(metrics).Should(ContainSubstring("goscaffold_http_request_duration_seconds_count 2\n"))
+		Expect(metrics).Should(ContainSubstring("goscaffold_http_requests_in_flight 0\n"))
+		Expect(metrics).Should(ContainSubstring("goscaffold_marked_down 0\n"))
+		// Scrapes do not run the health checks
+		Expect(metrics).ShouldNot(ContainSubstring("goscaffold_health_status"))
+		Expect(atomic.LoadInt32(&checks)).Should(BeZero())
+
+		s.MarkDown()
+		_, metrics = getText(fmt.Sprintf("http://%s/metrics", s.ManagementAddress()))
+		Expect(metrics).Should(ContainSubstring("goscaffold_marked_down 1\n"))
+
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+	})
+
+	It("Health metrics", func() {
+		s := CreateHTTPScaffold()
+		s.SetMetricsPath("/metrics")
+		s.SetHealthCheckInterval(time.Hour, 0)
+		var checks int32
+		s.AddHealthCheck("database", time.Second, true, func() (HealthStatus, error) {
+			atomic.AddInt32(&checks, 1)
+			return OK, nil
+		})
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopErr := s.Listen(&testHandler{})
+			stopChan <- stopErr
+		}()
+
+		Eventually(func() string {
+			_, metrics := getText(fmt.Sprintf("http://%s/metrics", s.InsecureAddress()))
+			return metrics
+		}, 5*time.Second).Should(ContainSubstring("goscaffold_health_status{status=\"OK\"} 1\n"))
+		_, metrics := getText(fmt.Sprintf("http://%s/metrics", s.InsecureAddress()))
+		Expect(metrics).Should(ContainSubstring("goscaffold_health_check_ok{check=\"database\"} 1\n"))
+		Expect(atomic.LoadInt32(&checks)).Should(BeEquivalentTo(1))
+
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+	})
+
 	It("Secure And Insecure Ports", func() {
 		s := CreateHTTPScaffold()
 		s.SetSecurePort(0)
@@ -367,6 +741,73 @@ var _ = Describe("Scaffold Tests", func() {
 		Eventually(stopChan).Should(Receive(Equal(shutdownErr)))
 	})
 
+	It("Mutual TLS", func() {
+		s := CreateHTTPScaffold()
+		s.SetSecurePort(0)
+		s.SetInsecurePort(-1)
+		s.SetKeyFile("./testkeys/clearkey.pem")
+		s.SetCertFile("./testkeys/clearcert.pem")
+		s.SetClientCAFile("./testkeys/cacert.pem")
+		s.SetClientAuth(RequireClientCert)
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopErr := s.Listen(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				id := FetchClientIdentity(r)
+				if id == nil {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				fmt.Fprintf(w, "%s %s %s %s", id.Subject.CommonName,
+					id.DNSNames[0], id.EmailAddresses[0], id.URIs[0])
+			}))
+			stopChan <- stopErr
+		}()
+
+		cert, err := tls.LoadX509KeyPair("./testkeys/clientcert.pem", "./testkeys/clientkey.pem")
+		Expect(err).Should(Succeed())
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: true,
+					Certificates:       []tls.Certificate{cert},
+				},
+			},
+		}
+
+		var resp *http.Response
+		Eventually(func() error {
+			resp, err = client.Get(fmt.Sprintf("https://%s", s.SecureAddress()))
+			return err
+		}, 5*time.Second).Should(Succeed())
+		bod, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		Expect(err).Should(Succeed())
+		Expect(resp.StatusCode).Should(Equal(200))
+		Expect(string(bod)).Should(Equal(
+			"scaffoldclient client.example.com client@example.com spiffe://example.com/scaffoldclient"))
+
+		// No certificate, no service
+		_, err = insecureClient.Get(fmt.Sprintf("https://%s", s.SecureAddress()))
+		Expect(err).ShouldNot(Succeed())
+
+		shutdownErr := errors.New("Validate")
+		s.Shutdown(shutdownErr)
+		Eventually(stopChan).Should(Receive(Equal(shutdownErr)))
+	})
+
+	It("Mutual TLS needs a CA", func() {
+		s := CreateHTTPScaffold()
+		s.SetSecurePort(0)
+		s.SetKeyFile("./testkeys/clearkey.pem")
+		s.SetCertFile("./testkeys/clearcert.pem")
+		s.SetClientAuth(RequestClientCert)
+		err := s.Open()
+		Expect(err).Should(MatchError("client CA file must be set"))
+	})
+
 	It("DisAllow non-localhost", func() {
 		s := CreateHTTPScaffold()
 		s.SetInsecurePort(8181)
@@ -475,6 +916,99 @@ var _ = Describe("Scaffold Tests", func() {
 		Expect(vals.Message).Should(Equal("Public key not configured. Validation failed."))
 	})
 
+	It("Access log with JWT subject", func() {
+		out := &syncBuffer{}
+		router := httprouter.New()
+		scaf := CreateHTTPScaffold()
+		scaf.SetAccessLog(out, JSONLogFormat)
+		err := scaf.Open()
+		Expect(err).Should(Succeed())
+		oauth := createLocalOAuth()
+		router.GET(oauth.SSOHandler("/foobar/:param1/:param2", buslogicHandler))
+		stopChan := make(chan error)
+		go func() {
+			stopChan <- scaf.Listen(router)
+		}()
+
+		req, err := http.NewRequest("GET",
+			"http://"+scaf.InsecureAddress()+"/foobar/xyz/123", nil)
+		Expect(err).Should(Succeed())
+		req.Header.Set("Authorization", "Bearer "+string(createJWT()))
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).Should(Succeed())
+		resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(200))
+
+		Eventually(out.String).Should(ContainSubstring(
+			`"user":"http://github.com/apid/goscaffold"`))
+
+		scaf.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+	})
+
+	It("Request IDs", func() {
+		router := httprouter.New()
+		scaf := CreateHTTPScaffold()
+		scaf.SetRequestIDHeader("X-Correlation-ID")
+		err := scaf.Open()
+		Expect(err).Should(Succeed())
+		oauth := createLocalOAuth()
+		router.GET(oauth.SSOHandler("/foobar/:param1/:param2", buslogicHandler))
+		router.GET("/id", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+			w.Write([]byte(FetchRequestID(r)))
+		})
+		stopChan := make(chan error)
+		go func() {
+			// Middleware that wraps the writer does not lose the ID
+			stopChan <- scaf.Listen(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				router.ServeHTTP(&wrappedWriter{w}, r)
+			}))
+		}()
+
+		// Generated ID is echoed and available to the handler
+		resp, err := http.Get("http://" + scaf.InsecureAddress() + "/id")
+		Expect(err).Should(Succeed())
+		bod, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		Expect(err).Should(Succeed())
+		Expect(resp.Header.Get("X-Correlation-ID")).ShouldNot(BeEmpty())
+		Expect(string(bod)).Should(Equal(resp.Header.Get("X-Correlation-ID")))
+
+		// Client ID is used in error responses
+		req, err := http.NewRequest("GET",
+			"http://"+scaf.InsecureAddress()+"/foobar/xyz/123", nil)
+		Expect(err).Should(Succeed())
+		req.Header.Set("Authorization", "Bearer DEADBEEF")
+		req.Header.Set("X-Correlation-ID", "my-request")
+		resp, err = http.DefaultClient.Do(req)
+		Expect(err).Should(Succeed())
+		Expect(resp.StatusCode).Should(Equal(400))
+		Expect(resp.Header.Get("X-Correlation-ID")).Should(Equal("my-request"))
+		var vals ErrorResponse
+		err = json.NewDecoder(resp.Body).Decode(&vals)
+		resp.Body.Close()
+		Expect(err).Should(Succeed())
+		Expect(vals.RequestID).Should(Equal("my-request"))
+
+		// And in 503 responses
+		scaf.MarkDown()
+		req, err = http.NewRequest("GET", "http://"+scaf.InsecureAddress()+"/id", nil)
+		Expect(err).Should(Succeed())
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("X-Correlation-ID", "down-request")
+		resp, err = http.DefaultClient.Do(req)
+		Expect(err).Should(Succeed())
+		Expect(resp.StatusCode).Should(Equal(503))
+		var js map[string]string
+		err = json.NewDecoder(resp.Body).Decode(&js)
+		resp.Body.Close()
+		Expect(err).Should(Succeed())
+		Expect(js["requestId"]).Should(Equal("down-request"))
+
+		scaf.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+	})
+
 	It("Get stack trace", func() {
 		b := &bytes.Buffer{}
 		dumpStack(b)
@@ -507,6 +1041,10 @@ func buslogicHandler(w http.ResponseWriter, r *http.Request) {
 	Expect(cid).To(Equal("123"))
 }
 
+type wrappedWriter struct {
+	http.ResponseWriter
+}
+
 func getText(url string) (int, string) {
 	req, err := http.NewRequest("GET", url, nil)
 	Expect(err).Should(Succeed())
@@ -534,6 +1072,20 @@ func getJSON(url string) (int, map[string]string) {
 	return resp.StatusCode, vals
 }
 
+func getReport(url string) (int, *healthReport) {
+	req, err := http.NewRequest("GET", url, nil)
+	Expect(err).Should(Succeed())
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	Expect(err).Should(Succeed())
+	defer resp.Body.Close()
+	Expect(resp.Header.Get("Content-Type")).Should(Equal("application/json"))
+	report := &healthReport{}
+	err = json.NewDecoder(resp.Body).Decode(report)
+	Expect(err).Should(Succeed())
+	return resp.StatusCode, report
+}
+
 func validatePprof(addr string) {
 	code, _ := getText(fmt.Sprintf("http://%s/debug/pprof/", addr))
 	Expect(code).Should(Equal(200))
@@ -570,6 +1122,23 @@ func testGetSecure(s *HTTPScaffold, path string) bool {
 	return true
 }
 
+type syncBuffer struct {
+	buf  bytes.Buffer
+	lock sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
 type testHandler struct {
 }
 
@@ -589,6 +1158,20 @@ func (h *testHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	if delayTime > 0 {
 		time.Sleep(delayTime)
 	}
+
+	waitStr := req.URL.Query().Get("wait")
+	if waitStr != "" {
+		waitTime, err := time.ParseDuration(waitStr)
+		if err != nil {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		select {
+		case <-time.After(waitTime):
+		case <-req.Context().Done():
+			resp.WriteHeader(http.StatusGatewayTimeout)
+		}
+	}
 }
 
 func GetLocalIP() []byte {
@@ -621,23 +1204,65 @@ func GetLocalIPStr() string {
 	return ""
 }
 
-func createJWT() []byte {
-	keyBytes, err := ioutil.ReadFile("./testkeys/jwtkey.pem")
+/*
+createLocalOAuth creates an OAuth verifier that uses the test public key
+without fetching it over the network.
+*/
+func createLocalOAuth() *oauth {
+	certBytes, err := ioutil.ReadFile("./testkeys/jwtcert.pem")
 	Expect(err).Should(Succeed())
-	pk, err := crypto.ParseRSAPrivateKeyFromPEM(keyBytes)
+	pk, err := crypto.ParseRSAPublicKeyFromPEM(certBytes)
 	Expect(err).Should(Succeed())
+	oa := &oauth{
+		rwMutex: &sync.RWMutex{},
+	}
+	oa.setKeysSafe(publicKeys{"": &publicKey{key: pk}})
+	return oa
+}
+
+func createJWT() []byte {
+	return createKeyedJWT("")
+}
+
+/*
+createKeyedJWT creates a token signed by the test key with a "kid" header,
+if "kid" is not empty.
+*/
+func createKeyedJWT(kid string) []byte {
+	return signTestJWT(crypto.SigningMethodRS256, testSigningKey(), kid)
+}
+
+var signingKey *rsa.PrivateKey
+
+/*
+testSigningKey returns the private key from "testkeys," which is only
+read once.
+*/
+func testSigningKey() *rsa.PrivateKey {
+	if signingKey == nil {
+		keyBytes, err := ioutil.ReadFile("./testkeys/jwtkey.pem")
+		Expect(err).Should(Succeed())
+		signingKey, err = crypto.ParseRSAPrivateKeyFromPEM(keyBytes)
+		Expect(err).Should(Succeed())
+	}
+	return signingKey
+}
+
+/*
+signTestJWT creates a token with the test claims using any signing method
+and key.
+*/
+func signTestJWT(method crypto.SigningMethod, key interface{}, kid string) []byte {
+	return signTestClaims(testClaims(), method, key, kid)
+}
+
+func signTestClaims(claims jws.Claims, method crypto.SigningMethod, key interface{}, kid string) []byte {
+	jwt := jws.NewJWT(claims, method)
+	if kid != "" {
+		jwt.(jws.JWS).Protected().Set("kid", kid)
+	}
 
-	claims := jws.Claims{}
-	now := time.Now()
-	claims.SetAudience("http://github.com/apid/goscaffold")
-	claims.SetIssuer("http://github.com/apid/goscaffold")
-	claims.SetSubject("http://github.com/apid/goscaffold")
-	claims.SetIssuedAt(now)
-	claims.SetNotBefore(now)
-	claims.SetExpiration(now.Add(time.Hour))
-	jwt := jws.NewJWT(claims, crypto.SigningMethodRS256)
-
-	rawJwt, err := jwt.Serialize(pk)
+	rawJwt, err := jwt.Serialize(key)
 	Expect(err).Should(Succeed())
 	return rawJwt
 }
@@ -0,0 +1,235 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+/*
+DefaultTLSMinVersion is the oldest version of TLS that the secure port
+accepts unless "SetTLSOptions" is used to change it.
+*/
+const DefaultTLSMinVersion = tls.VersionTLS12
+
+/*
+DefaultCipherSuites are the TLS 1.2 cipher suites that the secure port
+accepts unless "SetTLSOptions" is used to change them. They all use
+forward secrecy and authenticated encryption. TLS 1.3 cipher suites are
+not configurable.
+*/
+var DefaultCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+/*
+DefaultCurvePreferences are the elliptic curves that the secure port uses
+unless "SetTLSOptions" is used to change them.
+*/
+var DefaultCurvePreferences = []tls.CurveID{
+	tls.X25519,
+	tls.CurveP256,
+	tls.CurveP384,
+}
+
+/*
+TLSOptions controls the TLS protocol on the secure port. Zero values are
+replaced with "DefaultTLSMinVersion," "DefaultCipherSuites," and
+"DefaultCurvePreferences." If "EnableHTTP2" is true, then HTTP/2 is offered
+to clients using ALPN. HTTP/2 needs TLS 1.2 or later and one of the default
+cipher suites.
+*/
+type TLSOptions struct {
+	MinVersion       uint16
+	CipherSuites     []uint16
+	CurvePreferences []tls.CurveID
+	EnableHTTP2      bool
+}
+
+/*
+ClientAuthMode determines whether the secure port asks clients to present
+a TLS certificate.
+*/
+type ClientAuthMode int
+
+const (
+	// NoClientCert means that clients are not asked for a certificate
+	NoClientCert ClientAuthMode = iota
+	// RequestClientCert means that clients are asked for a certificate, which
+	// must be signed by the client CA if it is presented
+	RequestClientCert
+	// RequireClientCert means that clients must present a certificate that
+	// is signed by the client CA
+	RequireClientCert
+)
+
+/*
+ClientIdentity describes the verified certificate that a client presented
+on the secure port.
+*/
+type ClientIdentity struct {
+	Subject        pkix.Name
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []net.IP
+	URIs           []*url.URL
+	Certificate    *x509.Certificate
+}
+
+/*
+SetClientCAFile sets the name of a file that contains one or more PEM-encoded
+CA certificates. Certificates that clients present on the secure port must
+be signed by one of them. It is only consulted if "securePort" is >= 0 and
+the client auth mode is not NoClientCert.
+*/
+func (s *HTTPScaffold) SetClientCAFile(fn string) {
+	s.clientCAFile = fn
+}
+
+/*
+SetClientAuth sets whether clients must present a certificate on the
+secure port. The default is NoClientCert. For any other mode,
+"SetClientCAFile" must also be called. The identity from a verified
+certificate is available to handlers using FetchClientIdentity.
+*/
+func (s *HTTPScaffold) SetClientAuth(mode ClientAuthMode) {
+	s.clientAuth = mode
+}
+
+/*
+SetTLSOptions sets the TLS versions, cipher suites, curves, and protocols
+that the secure port uses. It must be called before "Open."
+*/
+func (s *HTTPScaffold) SetTLSOptions(o TLSOptions) {
+	s.tlsOptions = o
+}
+
+/*
+FetchClientIdentity returns the identity from the certificate that the
+client presented, or nil if there was no verified certificate.
+*/
+func FetchClientIdentity(r *http.Request) *ClientIdentity {
+	id, _ := r.Context().Value(clientIdentityKey).(*ClientIdentity)
+	return id
+}
+
+/*
+createTLSConfig loads the certificates and builds the configuration for
+the secure port.
+*/
+func (s *HTTPScaffold) createTLSConfig() (*tls.Config, error) {
+	loader, err := s.createCertificateLoader()
+	if err != nil {
+		return nil, err
+	}
+	s.certLoader = loader
+	// Not critical, since the old certificates are still being served
+	s.replaceHealthCheck("tls-certificate", 0, false, loader.healthCheck)
+	if s.certExpiryWindow > 0 {
+		var logf func(string, ...interface{})
+		if !s.certExpiryCritical {
+			logf = s.logf
+		}
+		s.replaceHealthCheck("tls-certificate-expiry", 0, s.certExpiryCritical,
+			loader.expiryCheck(s.certExpiryWindow, logf))
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate:   loader.getCertificate,
+		MinVersion:       s.tlsOptions.MinVersion,
+		CipherSuites:     s.tlsOptions.CipherSuites,
+		CurvePreferences: s.tlsOptions.CurvePreferences,
+		NextProtos:       []string{"http/1.1"},
+	}
+	if tlsConfig.MinVersion == 0 {
+		tlsConfig.MinVersion = DefaultTLSMinVersion
+	}
+	if len(tlsConfig.CipherSuites) == 0 {
+		tlsConfig.CipherSuites = DefaultCipherSuites
+	}
+	if len(tlsConfig.CurvePreferences) == 0 {
+		tlsConfig.CurvePreferences = DefaultCurvePreferences
+	}
+	if s.tlsOptions.EnableHTTP2 {
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	switch s.clientAuth {
+	case NoClientCert:
+		tlsConfig.ClientAuth = tls.NoClientCert
+	case RequestClientCert:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case RequireClientCert:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("Invalid client auth mode %d", s.clientAuth)
+	}
+	if s.clientAuth != NoClientCert {
+		pool, err := loadCertPool(s.clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+func loadCertPool(fn string) (*x509.CertPool, error) {
+	if fn == "" {
+		return nil, errors.New("client CA file must be set")
+	}
+	pem, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in %s", fn)
+	}
+	return pool, nil
+}
+
+/*
+clientIdentity extracts the identity from the verified client certificate
+on the connection, if there is one.
+*/
+func clientIdentity(req *http.Request) *ClientIdentity {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 ||
+		len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+	return &ClientIdentity{
+		Subject:        cert.Subject,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		IPAddresses:    cert.IPAddresses,
+		URIs:           cert.URIs,
+		Certificate:    cert,
+	}
+}
@@ -0,0 +1,581 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TLS tests", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "goscaffold")
+		Expect(err).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	It("Reload certificate", func() {
+		certFile := filepath.Join(tmpDir, "cert.pem")
+		keyFile := filepath.Join(tmpDir, "key.pem")
+		writeTestCert(certFile, keyFile, "first", time.Now().Add(time.Hour))
+
+		s := CreateHTTPScaffold()
+		s.SetSecurePort(0)
+		s.SetInsecurePort(-1)
+		s.SetManagementPort(0)
+		s.SetHealthPath("/health")
+		s.SetCertFile(certFile)
+		s.SetKeyFile(keyFile)
+		Expect(s.ReloadCertificates()).ShouldNot(Succeed())
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		stopChan := make(chan error)
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(func() string {
+			return servedCommonName(s)
+		}, 5*time.Second).Should(Equal("first"))
+
+		writeTestCert(certFile, keyFile, "second", time.Now().Add(time.Hour))
+		Expect(s.ReloadCertificates()).Should(Succeed())
+		Expect(servedCommonName(s)).Should(Equal("second"))
+
+		// A bad certificate is reported and the old one is kept
+		err = ioutil.WriteFile(certFile, []byte("Not a certificate"), 0600)
+		Expect(err).Should(Succeed())
+		Expect(s.ReloadCertificates()).ShouldNot(Succeed())
+		Expect(servedCommonName(s)).Should(Equal("second"))
+
+		code, report := getReport(fmt.Sprintf("http://%s/health", s.ManagementAddress()))
+		Expect(code).Should(Equal(200))
+		Expect(report.Status).Should(Equal("OK"))
+		Expect(report.Checks).Should(HaveLen(1))
+		Expect(report.Checks[0].Name).Should(Equal("tls-certificate"))
+		Expect(report.Checks[0].Critical).Should(BeFalse())
+		Expect(report.Checks[0].Status).Should(Equal("NotReady"))
+		Expect(report.Checks[0].Error).Should(ContainSubstring("Cannot reload certificate"))
+
+		writeTestCert(certFile, keyFile, "third", time.Now().Add(time.Hour))
+		Expect(s.ReloadCertificates()).Should(Succeed())
+		code, report = getReport(fmt.Sprintf("http://%s/health", s.ManagementAddress()))
+		Expect(code).Should(Equal(200))
+		Expect(report.Status).Should(Equal("OK"))
+		Expect(report.Checks[0].Status).Should(Equal("OK"))
+
+		// The check is only registered once
+		_, err = s.createTLSConfig()
+		Expect(err).Should(Succeed())
+		Expect(s.healthChecks).Should(HaveLen(1))
+
+		shutdownErr := errors.New("Validate")
+		s.Shutdown(shutdownErr)
+		Eventually(stopChan).Should(Receive(Equal(shutdownErr)))
+	})
+
+	It("Watch certificate", func() {
+		certFile := filepath.Join(tmpDir, "cert.pem")
+		keyFile := filepath.Join(tmpDir, "key.pem")
+		writeTestCert(certFile, keyFile, "first", time.Now().Add(time.Hour))
+
+		s := CreateHTTPScaffold()
+		s.SetSecurePort(0)
+		s.SetInsecurePort(-1)
+		s.SetCertFile(certFile)
+		s.SetKeyFile(keyFile)
+		s.SetCertReloadInterval(50 * time.Millisecond)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		stopChan := make(chan error)
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(func() string {
+			return servedCommonName(s)
+		}, 5*time.Second).Should(Equal("first"))
+
+		writeTestCert(certFile, keyFile, "second", time.Now().Add(time.Hour))
+		// Make sure that the change is visible on file systems with coarse times
+		later := time.Now().Add(time.Minute)
+		os.Chtimes(certFile, later, later)
+		Eventually(func() string {
+			return servedCommonName(s)
+		}, 5*time.Second).Should(Equal("second"))
+
+		shutdownErr := errors.New("Validate")
+		s.Shutdown(shutdownErr)
+		Eventually(stopChan).Should(Receive(Equal(shutdownErr)))
+	})
+
+	It("Mismatched key", func() {
+		writeTestCert(filepath.Join(tmpDir, "cert.pem"), filepath.Join(tmpDir, "key.pem"),
+			"first", time.Now().Add(time.Hour))
+		l := &certificateLoader{
+			sources: []certificateSource{{
+				certFile: filepath.Join(tmpDir, "cert.pem"),
+				keyFile:  "./testkeys/clearkey.pem",
+			}},
+		}
+		Expect(l.load()).ShouldNot(Succeed())
+		status, err := l.healthCheck()
+		Expect(status).Should(Equal(NotReady))
+		Expect(err).ShouldNot(Succeed())
+	})
+
+	It("Encrypted keys", func() {
+		goodPass := func() ([]byte, error) { return []byte("secret"), nil }
+		badPass := func() ([]byte, error) { return []byte("wrong"), nil }
+		failPass := func() ([]byte, error) { return nil, errors.New("No password") }
+
+		clear, err := tls.LoadX509KeyPair("./testkeys/clearcert.pem", "./testkeys/clearkey.pem")
+		Expect(err).Should(Succeed())
+
+		for _, fn := range []string{"./testkeys/pkcs8key.pem", "./testkeys/encryptedkey.pem"} {
+			cert, err := loadKeyPair("./testkeys/clearcert.pem", fn, goodPass)
+			Expect(err).Should(Succeed())
+			Expect(cert.PrivateKey).Should(Equal(clear.PrivateKey))
+
+			_, err = loadKeyPair("./testkeys/clearcert.pem", fn, badPass)
+			Expect(errors.Is(err, ErrIncorrectPassword)).Should(BeTrue())
+
+			_, err = loadKeyPair("./testkeys/clearcert.pem", fn, failPass)
+			Expect(err).Should(MatchError(ContainSubstring("No password")))
+		}
+
+		// Plain keys do not need the password
+		_, err = loadKeyPair("./testkeys/clearcert.pem", "./testkeys/clearkey.pem", failPass)
+		Expect(err).Should(Succeed())
+	})
+
+	It("Open with encrypted key", func() {
+		s := CreateHTTPScaffold()
+		s.SetSecurePort(0)
+		s.SetInsecurePort(-1)
+		s.SetCertFile("./testkeys/clearcert.pem")
+		s.SetKeyFileWithPassword("./testkeys/pkcs8key.pem", func() ([]byte, error) {
+			return []byte("wrong"), nil
+		})
+		err := s.Open()
+		Expect(errors.Is(err, ErrIncorrectPassword)).Should(BeTrue())
+
+		s = CreateHTTPScaffold()
+		s.SetSecurePort(0)
+		s.SetInsecurePort(-1)
+		s.SetCertFile("./testkeys/clearcert.pem")
+		s.SetKeyFileWithPassword("./testkeys/pkcs8key.pem", func() ([]byte, error) {
+			return []byte("secret"), nil
+		})
+		err = s.Open()
+		Expect(err).Should(Succeed())
+
+		stopChan := make(chan error)
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(func() string {
+			return servedCommonName(s)
+		}, 5*time.Second).Should(Equal("clearserver"))
+
+		shutdownErr := errors.New("Validate")
+		s.Shutdown(shutdownErr)
+		Eventually(stopChan).Should(Receive(Equal(shutdownErr)))
+	})
+
+	It("TLS defaults", func() {
+		s := CreateHTTPScaffold()
+		s.SetSecurePort(0)
+		s.SetInsecurePort(-1)
+		s.SetCertFile("./testkeys/clearcert.pem")
+		s.SetKeyFile("./testkeys/clearkey.pem")
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		stopChan := make(chan error)
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(func() string {
+			return servedCommonName(s)
+		}, 5*time.Second).Should(Equal("clearserver"))
+
+		// Old versions and weak cipher suites are refused
+		_, err = tls.Dial("tcp", s.SecureAddress(), &tls.Config{
+			InsecureSkipVerify: true,
+			MinVersion:         tls.VersionTLS10,
+			MaxVersion:         tls.VersionTLS11,
+		})
+		Expect(err).ShouldNot(Succeed())
+		_, err = tls.Dial("tcp", s.SecureAddress(), &tls.Config{
+			InsecureSkipVerify: true,
+			MaxVersion:         tls.VersionTLS12,
+			CipherSuites:       []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA},
+		})
+		Expect(err).ShouldNot(Succeed())
+
+		// No HTTP/2 unless it is enabled
+		resp, err := http2Client().Get(fmt.Sprintf("https://%s", s.SecureAddress()))
+		Expect(err).Should(Succeed())
+		resp.Body.Close()
+		Expect(resp.ProtoMajor).Should(Equal(1))
+
+		shutdownErr := errors.New("Validate")
+		s.Shutdown(shutdownErr)
+		Eventually(stopChan).Should(Receive(Equal(shutdownErr)))
+	})
+
+	It("TLS options", func() {
+		s := CreateHTTPScaffold()
+		s.SetSecurePort(0)
+		s.SetInsecurePort(-1)
+		s.SetCertFile("./testkeys/clearcert.pem")
+		s.SetKeyFile("./testkeys/clearkey.pem")
+		s.SetTLSOptions(TLSOptions{
+			MinVersion:  tls.VersionTLS13,
+			EnableHTTP2: true,
+		})
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		stopChan := make(chan error)
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(func() string {
+			return servedCommonName(s)
+		}, 5*time.Second).Should(Equal("clearserver"))
+
+		_, err = tls.Dial("tcp", s.SecureAddress(), &tls.Config{
+			InsecureSkipVerify: true,
+			MaxVersion:         tls.VersionTLS12,
+		})
+		Expect(err).ShouldNot(Succeed())
+
+		resp, err := http2Client().Get(fmt.Sprintf("https://%s", s.SecureAddress()))
+		Expect(err).Should(Succeed())
+		resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(200))
+		Expect(resp.ProtoMajor).Should(Equal(2))
+
+		shutdownErr := errors.New("Validate")
+		s.Shutdown(shutdownErr)
+		Eventually(stopChan).Should(Receive(Equal(shutdownErr)))
+	})
+
+	It("SNI", func() {
+		writeTestCert(filepath.Join(tmpDir, "one.crt"), filepath.Join(tmpDir, "one.key"),
+			"one.example.com", time.Now().Add(time.Hour))
+		writeTestCert(filepath.Join(tmpDir, "two.crt"), filepath.Join(tmpDir, "two.key"),
+			"*.two.example.com", time.Now().Add(2*time.Hour))
+		// No key, so not loaded
+		writeTestCert(filepath.Join(tmpDir, "ca.crt"), filepath.Join(tmpDir, "ca.pem"),
+			"ca.example.com", time.Now().Add(time.Hour))
+		extraDir := filepath.Join(tmpDir, "extra")
+		Expect(os.Mkdir(extraDir, 0700)).Should(Succeed())
+		writeTestCert(filepath.Join(extraDir, "cert.pem"), filepath.Join(extraDir, "key.pem"),
+			"three.example.com", time.Now().Add(3*time.Hour))
+
+		s := CreateHTTPScaffold()
+		s.SetSecurePort(0)
+		s.SetInsecurePort(-1)
+		s.SetManagementPort(0)
+		s.SetCertificatesPath("/certificates")
+		s.SetCertFile("./testkeys/clearcert.pem")
+		s.SetKeyFile("./testkeys/clearkey.pem")
+		s.AddCertificate(filepath.Join(extraDir, "cert.pem"), filepath.Join(extraDir, "key.pem"), nil)
+		s.SetCertDirectory(tmpDir)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		stopChan := make(chan error)
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(func() string {
+			return servedCommonName(s)
+		}, 5*time.Second).Should(Equal("clearserver"))
+		Expect(sniCommonName(s, "one.example.com")).Should(Equal("one.example.com"))
+		Expect(sniCommonName(s, "ONE.example.com.")).Should(Equal("one.example.com"))
+		Expect(sniCommonName(s, "foo.two.example.com")).Should(Equal("*.two.example.com"))
+		Expect(sniCommonName(s, "three.example.com")).Should(Equal("three.example.com"))
+		Expect(sniCommonName(s, "ca.example.com")).Should(Equal("clearserver"))
+		Expect(sniCommonName(s, "unknown.example.com")).Should(Equal("clearserver"))
+
+		resp, err := http.Get(fmt.Sprintf("http://%s/certificates", s.ManagementAddress()))
+		Expect(err).Should(Succeed())
+		var infos []certificateInfo
+		err = json.NewDecoder(resp.Body).Decode(&infos)
+		resp.Body.Close()
+		Expect(err).Should(Succeed())
+		Expect(resp.Header.Get("Content-Type")).Should(Equal("application/json"))
+		Expect(infos).Should(HaveLen(4))
+		Expect(infos[0].CertFile).Should(Equal("./testkeys/clearcert.pem"))
+		Expect(infos[0].Default).Should(BeTrue())
+		Expect(infos[0].NotAfter.Year()).Should(Equal(2044))
+		Expect(infos[1].DNSNames).Should(Equal([]string{"three.example.com"}))
+		Expect(infos[1].Default).Should(BeFalse())
+		Expect(infos[2].CertFile).Should(Equal(filepath.Join(tmpDir, "one.crt")))
+		Expect(infos[3].CertFile).Should(Equal(filepath.Join(tmpDir, "two.crt")))
+		Expect(infos[3].NotAfter).Should(BeTemporally(">", time.Now().Add(time.Hour)))
+
+		// New files in the directory are picked up
+		writeTestCert(filepath.Join(tmpDir, "four.crt"), filepath.Join(tmpDir, "four.key"),
+			"four.example.com", time.Now().Add(time.Hour))
+		Expect(s.ReloadCertificates()).Should(Succeed())
+		Expect(sniCommonName(s, "four.example.com")).Should(Equal("four.example.com"))
+
+		shutdownErr := errors.New("Validate")
+		s.Shutdown(shutdownErr)
+		Eventually(stopChan).Should(Receive(Equal(shutdownErr)))
+	})
+
+	It("Certificate directory only", func() {
+		s := CreateHTTPScaffold()
+		s.SetSecurePort(0)
+		s.SetCertDirectory(tmpDir)
+		err := s.Open()
+		Expect(err).Should(MatchError("No certificates found"))
+
+		writeTestCert(filepath.Join(tmpDir, "b.crt"), filepath.Join(tmpDir, "b.key"),
+			"b.example.com", time.Now().Add(time.Hour))
+		writeTestCert(filepath.Join(tmpDir, "a.crt"), filepath.Join(tmpDir, "a.key"),
+			"a.example.com", time.Now().Add(time.Hour))
+		l := &certificateLoader{dir: tmpDir}
+		Expect(l.load()).Should(Succeed())
+		cert, err := l.getCertificate(&tls.ClientHelloInfo{})
+		Expect(err).Should(Succeed())
+		Expect(cert.Leaf.Subject.CommonName).Should(Equal("a.example.com"))
+	})
+
+	It("Certificate expiry", func() {
+		certFile := filepath.Join(tmpDir, "cert.pem")
+		keyFile := filepath.Join(tmpDir, "key.pem")
+		writeTestCert(certFile, keyFile, "leaf.example.com", time.Now().Add(48*time.Hour))
+		expires := time.Now().Add(time.Hour).Truncate(time.Second)
+		writeTestCert(filepath.Join(tmpDir, "ca.pem"), filepath.Join(tmpDir, "cakey.pem"),
+			"ca.example.com", expires)
+
+		// Certificate chain where the second one expires first
+		leafPEM, err := ioutil.ReadFile(certFile)
+		Expect(err).Should(Succeed())
+		caPEM, err := ioutil.ReadFile(filepath.Join(tmpDir, "ca.pem"))
+		Expect(err).Should(Succeed())
+		err = ioutil.WriteFile(certFile, append(leafPEM, caPEM...), 0600)
+		Expect(err).Should(Succeed())
+
+		s := CreateHTTPScaffold()
+		s.SetSecurePort(0)
+		s.SetInsecurePort(-1)
+		s.SetManagementPort(0)
+		s.SetReadyPath("/ready")
+		s.SetMetricsPath("/metrics")
+		s.SetCertFile(certFile)
+		s.SetKeyFile(keyFile)
+		s.SetCertExpiryWindow(2*time.Hour, true)
+		err = s.Open()
+		Expect(err).Should(Succeed())
+
+		stopChan := make(chan error)
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(func() string {
+			return servedCommonName(s)
+		}, 5*time.Second).Should(Equal("leaf.example.com"))
+
+		code, report := getReport(fmt.Sprintf("http://%s/ready", s.ManagementAddress()))
+		Expect(code).Should(Equal(503))
+		Expect(report.Status).Should(Equal("NotReady"))
+		Expect(report.Reason).Should(HavePrefix("tls-certificate-expiry: " + certFile + " expires at"))
+		Expect(report.Certificates).Should(HaveLen(1))
+		Expect(report.Certificates[0].Expires.Equal(expires)).Should(BeTrue())
+		Expect(report.Certificates[0].NotAfter).Should(BeTemporally(">", expires))
+
+		code, metrics := getText(fmt.Sprintf("http://%s/metrics", s.ManagementAddress()))
+		Expect(code).Should(Equal(200))
+		Expect(metrics).Should(ContainSubstring(fmt.Sprintf(
+			"goscaffold_tls_certificate_expiry_timestamp_seconds{cert_file=\"%s\"} %d\n",
+			certFile, expires.Unix())))
+
+		shutdownErr := errors.New("Validate")
+		s.Shutdown(shutdownErr)
+		Eventually(stopChan).Should(Receive(Equal(shutdownErr)))
+	})
+
+	It("Certificate expiry check", func() {
+		s := CreateHTTPScaffold()
+		s.SetCertFile("./testkeys/clearcert.pem")
+		s.SetKeyFile("./testkeys/clearkey.pem")
+		_, err := s.createTLSConfig()
+		Expect(err).Should(Succeed())
+		Expect(s.healthChecks).Should(HaveLen(1))
+		Expect(s.healthChecks[0].name).Should(Equal("tls-certificate"))
+
+		// Only registered when there is a window
+		s.SetCertExpiryWindow(time.Hour, false)
+		_, err = s.createTLSConfig()
+		Expect(err).Should(Succeed())
+		Expect(s.healthChecks).Should(HaveLen(2))
+		Expect(s.healthChecks[1].name).Should(Equal("tls-certificate-expiry"))
+	})
+
+	It("Certificate expiry warning", func() {
+		certFile := filepath.Join(tmpDir, "cert.pem")
+		keyFile := filepath.Join(tmpDir, "key.pem")
+		writeTestCert(certFile, keyFile, "leaf.example.com", time.Now().Add(time.Hour))
+
+		logBuf := &syncBuffer{}
+		s := CreateHTTPScaffold()
+		s.SetSecurePort(0)
+		s.SetInsecurePort(-1)
+		s.SetManagementPort(0)
+		s.SetReadyPath("/ready")
+		s.SetCertFile(certFile)
+		s.SetKeyFile(keyFile)
+		s.SetServerOptions(ServerOptions{
+			ErrorLog: log.New(logBuf, "", 0),
+		})
+		s.SetCertExpiryWindow(2*time.Hour, false)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		stopChan := make(chan error)
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(func() string {
+			return servedCommonName(s)
+		}, 5*time.Second).Should(Equal("leaf.example.com"))
+
+		for i := 0; i < 2; i++ {
+			code, report := getReport(fmt.Sprintf("http://%s/ready", s.ManagementAddress()))
+			Expect(code).Should(Equal(200))
+			Expect(report.Checks).Should(HaveLen(2))
+			Expect(report.Checks[1].Name).Should(Equal("tls-certificate-expiry"))
+			Expect(report.Checks[1].Status).Should(Equal("NotReady"))
+		}
+		Expect(strings.Count(logBuf.String(), "Warning: TLS certificate "+certFile)).Should(Equal(1))
+
+		shutdownErr := errors.New("Validate")
+		s.Shutdown(shutdownErr)
+		Eventually(stopChan).Should(Receive(Equal(shutdownErr)))
+	})
+})
+
+/*
+writeTestCert generates a self-signed certificate and key.
+*/
+func writeTestCert(certFile, keyFile, cn string, notAfter time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).Should(Succeed())
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	Expect(err).Should(Succeed())
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	Expect(err).Should(Succeed())
+
+	err = ioutil.WriteFile(certFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	Expect(err).Should(Succeed())
+	err = ioutil.WriteFile(keyFile,
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	Expect(err).Should(Succeed())
+}
+
+/*
+servedCommonName connects to the secure port and returns the common name
+of the certificate that the server presented.
+*/
+func servedCommonName(s *HTTPScaffold) string {
+	conn, err := tls.Dial("tcp", s.SecureAddress(), &tls.Config{
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+/*
+sniCommonName is like "servedCommonName" but asks for a server name.
+*/
+func sniCommonName(s *HTTPScaffold, serverName string) string {
+	conn, err := tls.Dial("tcp", s.SecureAddress(), &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         serverName,
+	})
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+/*
+http2Client returns a client that will use HTTP/2 if the server offers it.
+*/
+func http2Client() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+			ForceAttemptHTTP2: true,
+		},
+	}
+}
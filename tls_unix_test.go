@@ -0,0 +1,77 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package goscaffold
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Certificate reload signal tests", func() {
+	It("Reload on signal", func() {
+		tmpDir, err := ioutil.TempDir("", "goscaffold")
+		Expect(err).Should(Succeed())
+		defer os.RemoveAll(tmpDir)
+		certFile := filepath.Join(tmpDir, "cert.pem")
+		keyFile := filepath.Join(tmpDir, "key.pem")
+		writeTestCert(certFile, keyFile, "first", time.Now().Add(time.Hour))
+
+		s := CreateHTTPScaffold()
+		s.SetSecurePort(0)
+		s.SetInsecurePort(-1)
+		s.SetCertFile(certFile)
+		s.SetKeyFile(keyFile)
+		s.SetCertReloadSignal(syscall.SIGUSR1)
+		err = s.Open()
+		Expect(err).Should(Succeed())
+		out := &syncBuffer{}
+		s.CatchSignalsTo(out)
+
+		stopChan := make(chan error)
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(func() string {
+			return servedCommonName(s)
+		}, 5*time.Second).Should(Equal("first"))
+
+		writeTestCert(certFile, keyFile, "second", time.Now().Add(time.Hour))
+		Expect(syscall.Kill(os.Getpid(), syscall.SIGUSR1)).Should(Succeed())
+		Eventually(func() string {
+			return servedCommonName(s)
+		}, 5*time.Second).Should(Equal("second"))
+
+		err = ioutil.WriteFile(certFile, []byte("Not a certificate"), 0600)
+		Expect(err).Should(Succeed())
+		Expect(syscall.Kill(os.Getpid(), syscall.SIGUSR1)).Should(Succeed())
+		Eventually(out.String, 5*time.Second).Should(ContainSubstring("Certificate reload failed"))
+		Expect(servedCommonName(s)).Should(Equal("second"))
+
+		shutdownErr := errors.New("Validate")
+		s.Shutdown(shutdownErr)
+		Eventually(stopChan).Should(Receive(Equal(shutdownErr)))
+	})
+})
@@ -15,7 +15,9 @@
 package goscaffold
 
 import (
+	"context"
 	"math"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -27,6 +29,7 @@ const (
 	startRequest = iota
 	endRequest
 	shutdown
+	abort
 )
 
 /*
@@ -49,24 +52,47 @@ type requestTracker struct {
 	// If "shutdown" is never called then this will never happen.
 	C              chan error
 	shutdownWait   time.Duration
+	preDrainDelay  time.Duration
 	shutdownState  int32
 	shutdownReason *atomic.Value
 	commandChan    chan int
+	active         int64
+	// shutdownCtx is cancelled as soon as we are marked down. It is replaced
+	// if we are marked up again.
+	shutdownCtx    context.Context
+	cancelShutdown context.CancelFunc
+	ctxLock        *sync.Mutex
+	// stopRequested is set, under ctxLock, as soon as "shutdown" or "abort"
+	// is called, so that the reason is not replaced by a markdown during
+	// the pre-drain delay.
+	stopRequested bool
+	// graceCtx is cancelled when we stop waiting for requests to complete.
+	graceCtx    context.Context
+	cancelGrace context.CancelFunc
+	// deadline is when the grace timeout expires, in Unix nanoseconds.
+	// It is set once we start to wait for requests to complete.
+	deadline int64
 }
 
 /*
 startRequestTracker creates a new tracker. shutdownWait defines the
 maximum amount of time that we should wait for shutdown in case some
-do not complete in a timely way.
+do not complete in a timely way. preDrainDelay defines how long we should
+keep on serving normally after shutdown is requested and before we start
+to reject new requests.
 */
-func startRequestTracker(shutdownWait time.Duration) *requestTracker {
+func startRequestTracker(shutdownWait, preDrainDelay time.Duration) *requestTracker {
 	rt := &requestTracker{
 		C:              make(chan error, 1),
 		commandChan:    make(chan int, 100),
 		shutdownState:  running,
 		shutdownWait:   shutdownWait,
+		preDrainDelay:  preDrainDelay,
 		shutdownReason: &atomic.Value{},
+		ctxLock:        &sync.Mutex{},
 	}
+	rt.shutdownCtx, rt.cancelShutdown = context.WithCancel(context.Background())
+	rt.graceCtx, rt.cancelGrace = context.WithCancel(context.Background())
 	go rt.trackerLoop()
 	return rt
 }
@@ -79,6 +105,7 @@ shutting down.
 func (t *requestTracker) start() error {
 	md := t.markedDown()
 	if md == nil {
+		atomic.AddInt64(&t.active, 1)
 		t.commandChan <- startRequest
 	}
 	return md
@@ -89,9 +116,18 @@ end indicates that a request ended. In order for this thing to work, the
 caller needs to ensure that start and end are always paired.
 */
 func (t *requestTracker) end() {
+	atomic.AddInt64(&t.active, -1)
 	t.commandChan <- endRequest
 }
 
+/*
+activeRequests returns the number of requests that have started but not
+yet ended.
+*/
+func (t *requestTracker) activeRequests() int64 {
+	return atomic.LoadInt64(&t.active)
+}
+
 /*
 markedDown returns nil if everything is good, and an error if the server
 has been marked down. The error is the one that was sent to the
@@ -115,13 +151,93 @@ the number of running requests reaches zero. The "reason" will be returned
 as the result of the "start" call.
 */
 func (t *requestTracker) shutdown(reason error) {
-	t.shutdownReason.Store(&reason)
+	t.requestStop(reason)
 	t.commandChan <- shutdown
 }
 
-func (t *requestTracker) markDown() {
+/*
+abort is like shutdown, but the tracker stops right away without waiting
+for the pre-drain delay or for requests to complete. It is used when
+one of the servers fails.
+*/
+func (t *requestTracker) abort(reason error) {
+	t.requestStop(reason)
+	t.commandChan <- abort
+}
+
+func (t *requestTracker) requestStop(reason error) {
+	t.ctxLock.Lock()
+	defer t.ctxLock.Unlock()
+	t.shutdownReason.Store(&reason)
+	t.stopRequested = true
+}
+
+/*
+drainDeadline returns the time by which all connections should be closed.
+It is the end of the grace timeout, or now if the tracker was aborted.
+*/
+func (t *requestTracker) drainDeadline() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&t.deadline))
+}
+
+/*
+markDown causes new requests to be rejected, but does not start a shutdown.
+It has no effect if we are already marked down or shutting down, including
+during the pre-drain delay. It returns true only if the state was changed.
+*/
+func (t *requestTracker) markDown() bool {
+	t.ctxLock.Lock()
+	defer t.ctxLock.Unlock()
+	if t.stopRequested || atomic.LoadInt32(&t.shutdownState) != running {
+		return false
+	}
 	t.shutdownReason.Store(&ErrMarkedDown)
 	atomic.StoreInt32(&t.shutdownState, markedDown)
+	t.cancelShutdown()
+	return true
+}
+
+/*
+markUp reverses the effect of "markDown." It returns an error if we are
+already shutting down, because that cannot be reversed.
+*/
+func (t *requestTracker) markUp() error {
+	t.ctxLock.Lock()
+	defer t.ctxLock.Unlock()
+	switch atomic.LoadInt32(&t.shutdownState) {
+	case running:
+		return nil
+	case markedDown:
+		atomic.StoreInt32(&t.shutdownState, running)
+		t.shutdownCtx, t.cancelShutdown = context.WithCancel(context.Background())
+		return nil
+	default:
+		return t.markedDown()
+	}
+}
+
+/*
+shutdownContext returns a context that is cancelled when we are
+marked down.
+*/
+func (t *requestTracker) shutdownContext() context.Context {
+	t.ctxLock.Lock()
+	defer t.ctxLock.Unlock()
+	return t.shutdownCtx
+}
+
+/*
+requestContext returns a context derived from "parent" that will be cancelled
+when the grace period expires, so that request handlers can give up.
+The returned function must be called when the request is done.
+*/
+func (t *requestTracker) requestContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	stop := context.AfterFunc(t.graceCtx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
 }
 
 func (t *requestTracker) sendStop(sent bool) bool {
@@ -130,6 +246,7 @@ func (t *requestTracker) sendStop(sent bool) bool {
 		if reason == nil {
 			return false
 		}
+		t.cancelGrace()
 		t.C <- *reason
 	}
 	return true
@@ -140,10 +257,26 @@ trackerLoop runs all day and manages stuff.
 */
 func (t *requestTracker) trackerLoop() {
 	activeRequests := 0
+	draining := false
 	stopping := false
 	sentStop := false
+	drainTimer := time.NewTimer(time.Duration(math.MaxInt64))
 	graceTimer := time.NewTimer(time.Duration(math.MaxInt64))
 
+	stop := func() {
+		stopping = true
+		atomic.StoreInt64(&t.deadline, time.Now().Add(t.shutdownWait).UnixNano())
+		t.ctxLock.Lock()
+		atomic.StoreInt32(&t.shutdownState, shutDown)
+		t.cancelShutdown()
+		t.ctxLock.Unlock()
+		if activeRequests <= 0 {
+			sentStop = t.sendStop(sentStop)
+		} else {
+			graceTimer.Reset(t.shutdownWait)
+		}
+	}
+
 	for !sentStop {
 		select {
 		case cmd := <-t.commandChan:
@@ -156,14 +289,26 @@ func (t *requestTracker) trackerLoop() {
 					sentStop = t.sendStop(sentStop)
 				}
 			case shutdown:
-				stopping = true
-				atomic.StoreInt32(&t.shutdownState, shutDown)
-				if activeRequests <= 0 {
-					sentStop = t.sendStop(sentStop)
+				if draining {
+					// Already waiting for the pre-drain delay to expire
+					break
+				}
+				if !stopping && t.preDrainDelay > 0 &&
+					atomic.LoadInt32(&t.shutdownState) == running {
+					// Keep serving so that load balancers have time to notice
+					draining = true
+					drainTimer.Reset(t.preDrainDelay)
 				} else {
-					graceTimer.Reset(t.shutdownWait)
+					stop()
 				}
+			case abort:
+				stop()
+				atomic.StoreInt64(&t.deadline, time.Now().UnixNano())
+				sentStop = t.sendStop(sentStop)
 			}
+		case <-drainTimer.C:
+			draining = false
+			stop()
 		case <-graceTimer.C:
 			sentStop = t.sendStop(sentStop)
 		}
@@ -15,7 +15,10 @@
 package goscaffold
 
 import (
+	"context"
 	"errors"
+	"net/http"
+	"net/http/httptest"
 	"time"
 
 	. "github.com/onsi/ginkgo"
@@ -24,7 +27,7 @@ import (
 
 var _ = Describe("Tracker tests", func() {
 	It("Basic tracker", func() {
-		t := startRequestTracker(10 * time.Second)
+		t := startRequestTracker(10*time.Second, 0)
 		t.start()
 		Consistently(t.C, 250*time.Millisecond).ShouldNot(Receive())
 		t.shutdown(errors.New("Basic"))
@@ -34,15 +37,97 @@ var _ = Describe("Tracker tests", func() {
 	})
 
 	It("Tracker stop idle", func() {
-		t := startRequestTracker(10 * time.Second)
+		t := startRequestTracker(10*time.Second, 0)
 		t.shutdown(errors.New("Stop"))
 		Eventually(t.C).Should(Receive(MatchError("Stop")))
 	})
 
 	It("Tracker grace timeout", func() {
-		t := startRequestTracker(time.Second)
+		t := startRequestTracker(time.Second, 0)
 		t.start()
 		t.shutdown(errors.New("Stop"))
 		Eventually(t.C, 2*time.Second).Should(Receive(MatchError("Stop")))
 	})
+	It("Tracker pre-drain delay", func() {
+		t := startRequestTracker(10*time.Second, time.Second)
+		t.shutdown(errors.New("Stop"))
+		// Requests are still accepted during the delay
+		Expect(t.markedDown()).Should(Succeed())
+		Expect(t.start()).Should(Succeed())
+		t.end()
+		Consistently(t.C, 500*time.Millisecond).ShouldNot(Receive())
+		Eventually(t.C, 2*time.Second).Should(Receive(MatchError("Stop")))
+		Expect(t.markedDown()).Should(MatchError("Stop"))
+	})
+
+	It("Tracker pre-drain then grace timeout", func() {
+		t := startRequestTracker(time.Second, 500*time.Millisecond)
+		t.start()
+		t.shutdown(errors.New("Stop"))
+		Consistently(t.C, 250*time.Millisecond).ShouldNot(Receive())
+		Eventually(t.markedDown, time.Second).Should(MatchError("Stop"))
+		Consistently(t.C, 500*time.Millisecond).ShouldNot(Receive())
+		Eventually(t.C, 2*time.Second).Should(Receive(MatchError("Stop")))
+	})
+
+	It("Tracker markdown during pre-drain delay", func() {
+		t := startRequestTracker(time.Second, 300*time.Millisecond)
+		t.shutdown(errors.New("Signal"))
+		Expect(t.markDown()).Should(BeFalse())
+		Eventually(t.C, 2*time.Second).Should(Receive(MatchError("Signal")))
+	})
+
+	It("Tracker pre-drain skipped when marked down", func() {
+		t := startRequestTracker(10*time.Second, time.Hour)
+		t.markDown()
+		t.shutdown(errors.New("Stop"))
+		Eventually(t.C).Should(Receive(MatchError("Stop")))
+	})
+	It("Tracker contexts", func() {
+		t := startRequestTracker(time.Second, 0)
+		Expect(t.start()).Should(Succeed())
+		ctx, cancel := t.requestContext(context.Background())
+		defer cancel()
+		Expect(t.shutdownCtx.Err()).Should(BeNil())
+		t.shutdown(errors.New("Stop"))
+		Eventually(t.shutdownCtx.Done()).Should(BeClosed())
+		Consistently(ctx.Done(), 500*time.Millisecond).ShouldNot(BeClosed())
+		Eventually(ctx.Done(), 2*time.Second).Should(BeClosed())
+		Eventually(t.C).Should(Receive(MatchError("Stop")))
+	})
+
+	It("Tracker handler panic", func() {
+		t := startRequestTracker(time.Second, 0)
+		h := &requestHandler{
+			s: &HTTPScaffold{tracker: t},
+			child: http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+				panic("Handler")
+			}),
+		}
+		Expect(t.start()).Should(Succeed())
+		Expect(func() {
+			h.serveTracked(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}).Should(Panic())
+		Expect(t.activeRequests()).Should(BeZero())
+	})
+
+	It("Tracker markdown context", func() {
+		t := startRequestTracker(time.Second, 0)
+		t.markDown()
+		Expect(t.shutdownCtx.Done()).Should(BeClosed())
+		Expect(t.graceCtx.Done()).ShouldNot(BeClosed())
+	})
+	It("Tracker mark up", func() {
+		t := startRequestTracker(10*time.Second, 0)
+		t.markDown()
+		Expect(t.start()).Should(MatchError(ErrMarkedDown))
+		Expect(t.shutdownContext().Done()).Should(BeClosed())
+		Expect(t.markUp()).Should(Succeed())
+		Expect(t.shutdownContext().Done()).ShouldNot(BeClosed())
+		Expect(t.start()).Should(Succeed())
+		t.end()
+		t.shutdown(errors.New("Stop"))
+		Eventually(t.C).Should(Receive(MatchError("Stop")))
+		Expect(t.markUp()).Should(MatchError("Stop"))
+	})
 })
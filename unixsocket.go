@@ -0,0 +1,105 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package goscaffold
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+listenUnixMode opens a Unix domain socket with the permissions in "mode."
+So that other users cannot connect before the permissions are set, the
+socket is created in a new private directory next to "path," its
+permissions are changed there, and then it is linked into place. Linking
+fails if something is already at "path."
+*/
+func listenUnixMode(path string, mode os.FileMode) (net.Listener, error) {
+	if mode == 0 {
+		return net.Listen("unix", path)
+	}
+
+	tmpDir, err := ioutil.TempDir(filepath.Dir(path), ".goscaffold")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tmpPath := filepath.Join(tmpDir, "s")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmpPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	l.SetUnlinkOnClose(false)
+
+	err = os.Chmod(tmpPath, mode)
+	if err == nil {
+		err = os.Link(tmpPath, path)
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &unixListener{
+		UnixListener: l,
+		addr:         &net.UnixAddr{Name: path, Net: "unix"},
+		unlink:       1,
+	}, nil
+}
+
+/*
+unixListener is a socket that was linked into place by "listenUnixMode."
+It reports the path that it was linked to as its address, and removes
+that path when it is closed, like the listeners from the "net" package.
+*/
+type unixListener struct {
+	*net.UnixListener
+	addr       *net.UnixAddr
+	unlink     int32
+	unlinkOnce sync.Once
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return l.addr
+}
+
+/*
+SetUnlinkOnClose sets whether the path is removed when the listener is
+closed, like the method of net.UnixListener.
+*/
+func (l *unixListener) SetUnlinkOnClose(unlink bool) {
+	if unlink {
+		atomic.StoreInt32(&l.unlink, 1)
+	} else {
+		atomic.StoreInt32(&l.unlink, 0)
+	}
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	if atomic.LoadInt32(&l.unlink) != 0 {
+		l.unlinkOnce.Do(func() {
+			os.Remove(l.addr.Name)
+		})
+	}
+	return err
+}
@@ -0,0 +1,38 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"net"
+	"os"
+)
+
+/*
+listenUnixMode opens a Unix domain socket and then changes its permissions
+to "mode," because Windows does not have a umask.
+*/
+func listenUnixMode(path string, mode os.FileMode) (net.Listener, error) {
+	l, err := net.Listen("unix", path)
+	if err != nil || mode == 0 {
+		return l, err
+	}
+	err = os.Chmod(path, mode)
+	if err != nil {
+		// Closing the listener removes the socket
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}